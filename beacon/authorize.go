@@ -0,0 +1,194 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// What beacons and their datasets require of the user, in visas or claims,
+// so that queries are only sent where the user is authorized
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+
+// The user on whose behalf queries are posed: the user's tokens, and how to
+// exchange them for a beacon's, and what is known of the user's visas and
+// claims
+type Principal struct {
+	AccessToken  string
+	IDToken      string
+	Subject      string                         // Verified issuer and subject; empty if unknown
+	Exchange     func(ctx context.Context, audience string, scope string) (string, error)  // nil if not possible
+	Visas        []Visa                         // Current visas from the user's passport
+	Claims       map[string]interface{}         // Verified claims about the user
+}
+
+// A visa held by the user, as far as requirements are concerned
+type Visa struct {
+	Type    string
+	Value   string
+	Source  string
+}
+
+// Something a beacon, or a dataset, requires of the user: a visa of a type,
+// perhaps with a given value and source, or a claim, perhaps with a value
+type Requirement struct {
+	Visa    string  `json:"visa,omitempty"`         // Type of visa, e.g. ControlledAccessGrants
+	Claim   string  `json:"claim,omitempty"`        // Name of claim, e.g. email_verified
+	Value   string  `json:"value,omitempty"`        // Value required, if any
+	Source  string  `json:"source,omitempty"`       // Source of visa required, if any
+}
+
+
+// Check that a requirement names either a visa or a claim
+func (r Requirement) validate() error {
+	if (r.Visa == "") == (r.Claim == "") {
+		return errors.New("requirement must name either a visa or a claim")
+	}
+	if r.Claim != "" && r.Source != "" {
+		return errors.New("requirement for claim " + r.Claim + " cannot have a source")
+	}
+	return nil
+}
+
+
+// Whether the principal meets a requirement. A claim with a list of values,
+// such as groups, meets it if any of them is the value required.
+func (r Requirement) metBy(p *Principal) bool {
+	if r.Visa != "" {
+		for _, v := range p.Visas {
+			if v.Type == r.Visa && (r.Value == "" || v.Value == r.Value) && (r.Source == "" || v.Source == r.Source) {
+				return true
+			}
+		}
+		return false
+	}
+
+	claim, ok := p.Claims[r.Claim]
+	if !ok || claim == nil {
+		return false
+	}
+	if r.Value == "" {
+		return true
+	}
+	if list, ok := claim.([]interface{}); ok {
+		for _, c := range list {
+			if fmt.Sprint(c) == r.Value {
+				return true
+			}
+		}
+		return false
+	}
+	return fmt.Sprint(claim) == r.Value
+}
+
+
+// Describe a requirement, e.g. a ControlledAccessGrants visa for <dataset>
+func (r Requirement) String() string {
+	var s string
+	if r.Visa != "" {
+		s = "a " + r.Visa + " visa"
+		if r.Value != "" {
+			s += " for " + r.Value
+		}
+		if r.Source != "" {
+			s += " from " + r.Source
+		}
+	} else {
+		s = "the claim " + r.Claim
+		if r.Value != "" {
+			s += " = " + r.Value
+		}
+	}
+	return s
+}
+
+
+// The requirements a principal doesn't meet
+func missingRequirements(requirements []Requirement, p *Principal) []Requirement {
+	var missing []Requirement
+	for _, r := range requirements {
+		if !r.metBy(p) {
+			missing = append(missing, r)
+		}
+	}
+	return missing
+}
+
+
+// Explain which requirements are missing
+func notAuthorized(what string, missing []Requirement) string {
+	described := make([]string, len(missing))
+	for i, r := range missing {
+		described[i] = r.String()
+	}
+	return "not authorized for this " + what + ": requires " + strings.Join(described, " and ")
+}
+
+
+// Check a beacon's requirements, and its datasets', for a principal. Returns
+// what is missing for the beacon as a whole; otherwise the datasets to query,
+// if any must be left out, and what is missing for each left out. Queries
+// for none of the beacon's datasets must not be sent at all; see noDatasetsAt.
+func authorize(b *beaconStruct, p *Principal, query *BeaconQuery) ([]Requirement, []string, map[string][]Requirement) {
+	if missing := missingRequirements(b.Requires, p); len(missing) > 0 {
+		return missing, nil, nil
+	}
+
+	var allowed []string
+	var refused map[string][]Requirement
+	for _, d := range queryDatasets(b, query) {
+		if missing := missingRequirements(b.DatasetRequires[d], p); len(missing) > 0 {
+			if refused == nil {
+				refused = make(map[string][]Requirement)
+			}
+			refused[d] = missing
+		} else {
+			allowed = append(allowed, d)
+		}
+	}
+
+	if refused == nil {
+		return nil, nil, nil
+	}
+	return nil, allowed, refused
+}
+
+
+// Check a beacon's configured requirements: each must be well formed, and
+// those for datasets must be for datasets the beacon queries
+func checkRequirements(b *beaconStruct) error {
+	for _, r := range b.Requires {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+	for d, requirements := range b.DatasetRequires {
+		if !contains(b.DatasetIds, d) {
+			return errors.New("requirements given for unknown dataset " + d)
+		}
+		for _, r := range requirements {
+			if err := r.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
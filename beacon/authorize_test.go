@@ -0,0 +1,71 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+
+// A beacon is only asked about the requested datasets it has, and not at all
+// if it has none of them; it is never left to answer for all of its own
+func TestQueryDatasetsElsewhere(t *testing.T) {
+	var asked []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked = append(asked, strings.Join(r.URL.Query()["datasetIds"], ","))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"exists": false}`))
+	}))
+	defer server.Close()
+
+	b := &beaconV1{}
+	b.initialize()
+	b.Name, b.Endpoint = "test", server.URL
+	b.DatasetIds = []string{"open", "controlled"}
+	b.DatasetRequires = map[string][]Requirement{"controlled": {{Visa: "ControlledAccessGrants", Value: "controlled"}}}
+	b.client, b.health, b.metadata = newClient((*beaconStruct)(b)), newBreaker(), &metadataCache{}
+
+	position := int64(32900705)
+	ask := func(datasets ...string) BeaconResponse {
+		query := &BeaconQuery{ReferenceName: "13", Start: &position, ReferenceBases: "A", AlternateBases: "T",
+			AssemblyId: "GRCh37", DatasetIds: datasets}
+		ch := make(chan BeaconResponse, 1)
+		queryBeacon(context.Background(), b, query, &Principal{}, ch)
+		return <-ch
+	}
+
+	response := ask("elsewhere")
+	if response.NotQueried == "" || len(response.Results) > 0 || len(response.Error) > 0 {
+		t.Errorf("dataset elsewhere: got %+v, want a beacon not queried", response)
+	}
+	if len(asked) > 0 {
+		t.Errorf("dataset elsewhere: beacon asked for datasets %q", asked)
+	}
+
+	response = ask("open", "elsewhere")
+	if response.NotQueried != "" {
+		t.Errorf("dataset open: not queried: %s", response.NotQueried)
+	}
+	if len(asked) != 1 || asked[0] != "open" {
+		t.Errorf("dataset open: beacon asked for datasets %q, want open", asked)
+	}
+}
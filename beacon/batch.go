@@ -0,0 +1,249 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// Batches of queries: parsing them, posing them to the beacons a few at a
+// time, and summarizing the results
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+
+// Number of a batch's queries in flight at once at each beacon, by default
+const defaultBatchConcurrency = 4
+
+// Largest number of queries in a batch, after expanding multi-allelic variants
+const maxBatchSize = 1000
+
+
+// Summary of a batch: for each query, the result from each beacon
+type BatchSummary struct {
+	Queries  []BeaconQuery   `json:"queries"`
+	Beacons  []string        `json:"beacons"`
+	Results  [][]string      `json:"results"`   // "true", "false", "unknown", "error", "unauthorized", or "" if no answer
+	column   map[string]int
+}
+
+
+// Parse a list of queries, each as accepted by ParseQueries but without
+// further batches. The defaults supply the assembly and datasets of any query
+// that doesn't give its own.
+func parseBatch(items []json.RawMessage, defaults BeaconQuery) ([]BeaconQuery, error) {
+	if describesVariant(&defaults) {
+		return nil, ValidationError{{"queries", "cannot be combined with other fields describing the variant"}}
+	}
+	defaults = BeaconQuery{AssemblyId: defaults.AssemblyId, DatasetIds: defaults.DatasetIds}
+
+	var errs ValidationError
+	queries := make([]BeaconQuery, 0, len(items))
+	for i, item := range items {
+		parsed, err := parseQueries(item, defaults, false)
+		if err != nil {
+			errs = append(errs, prefixErrors(fmt.Sprintf("queries[%d]", i), err)...)
+			continue
+		}
+		queries = append(queries, parsed...)
+	}
+
+	return checkBatch(queries, errs)
+}
+
+
+// Parse and validate the data lines of a VCF file, skipping headers, giving
+// one query for each alternate allele. The defaults supply the assembly and
+// datasets, as in ParseQueries.
+func ParseBatchVCF(text string, defaults BeaconQuery) ([]BeaconQuery, error) {
+	if describesVariant(&defaults) {
+		return nil, ValidationError{{"vcf", "cannot be combined with other fields describing the variant"}}
+	}
+
+	var errs ValidationError
+	queries := make([]BeaconQuery, 0)
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+	for line := 1; scanner.Scan(); line++ {
+		data := strings.TrimSpace(scanner.Text())
+		if data == "" || strings.HasPrefix(data, "#") {
+			continue
+		}
+
+		parsed, err := ParseVCF(data)
+		if err == nil {
+			parsed, err = mergeParsed(defaults, "vcf", parsed)
+		}
+		for i := 0; err == nil && i < len(parsed); i++ {
+			err = parsed[i].Validate()
+		}
+		if err != nil {
+			errs = append(errs, prefixErrors(fmt.Sprintf("vcf[%d]", line), err)...)
+			continue
+		}
+		queries = append(queries, parsed...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, ValidationError{{"vcf", "unreadable: " + err.Error()}}
+	}
+
+	if len(queries) == 0 && len(errs) == 0 {
+		return nil, ValidationError{{"vcf", "contains no data lines"}}
+	}
+	return checkBatch(queries, errs)
+}
+
+
+// Report the problems found with a batch, or that it is empty or too large
+func checkBatch(queries []BeaconQuery, errs ValidationError) ([]BeaconQuery, error) {
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if len(queries) == 0 {
+		return nil, ValidationError{{"queries", "must not be empty"}}
+	}
+	if len(queries) > maxBatchSize {
+		return nil, ValidationError{{"queries", fmt.Sprintf("a batch may contain at most %d queries", maxBatchSize)}}
+	}
+	return queries, nil
+}
+
+
+// Qualify the fields named in a validation error by the place in the batch
+// where they were found, e.g. queries[3].start
+func prefixErrors(prefix string, err error) ValidationError {
+	ve, ok := err.(ValidationError)
+	if !ok {
+		return ValidationError{{prefix, err.Error()}}
+	}
+
+	prefixed := make(ValidationError, len(ve))
+	for i, f := range ve {
+		prefixed[i] = f
+		if f.Field == "" || strings.HasPrefix(prefix, f.Field + "[") {
+			prefixed[i].Field = prefix
+		} else {
+			prefixed[i].Field = prefix + "." + f.Field
+		}
+	}
+	return prefixed
+}
+
+
+// Pose each of a batch of queries to all of the configured beacons, without
+// waiting for results. Each beacon is sent only a few of the queries at once,
+// so that a large batch doesn't overwhelm it. Each response is tagged with the
+// index of its query in the batch. Each query has its own timeout, starting
+// when it is sent; when ctx is cancelled, queries not yet sent are dropped.
+// The channel should have room for a response to every query from every
+// beacon.
+func QueryBatch(ctx context.Context, queries []BeaconQuery, principal *Principal, timeout int, ch chan<- BeaconResponse) {
+	for _, b := range beacons {
+		go func(b beacon) {
+			concurrency := common(b).BatchConcurrency
+			if concurrency <= 0 {
+				concurrency = defaultBatchConcurrency
+			}
+
+			slots := make(chan struct{}, concurrency)
+			for i := range queries {
+				select {
+				case slots <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+
+				go func(i int) {
+					defer func() { <-slots }()
+					qctx, cancel := context.WithTimeout(ctx, time.Second * time.Duration(timeout))
+					defer cancel()
+
+					inner := make(chan BeaconResponse, 1)
+					queryBeacon(qctx, b, &queries[i], principal, inner)
+					response := <-inner
+					response.QueryIndex = i
+					ch <- response
+				}(i)
+			}
+		}(b)
+	}
+}
+
+
+// Start a summary of the results of a batch of queries, with a column for
+// each configured beacon
+func NewBatchSummary(queries []BeaconQuery) *BatchSummary {
+	s := &BatchSummary{
+		Queries: queries,
+		Beacons: make([]string, len(beacons)),
+		Results: make([][]string, len(queries)),
+		column: make(map[string]int),
+	}
+
+	for i, b := range beacons {
+		s.Beacons[i] = common(b).Name
+		s.column[common(b).Name] = i
+	}
+	for i := range s.Results {
+		s.Results[i] = make([]string, len(beacons))
+	}
+
+	return s
+}
+
+
+// Record a beacon's response to one of the batch's queries: true if any
+// dataset has the variant, false if every dataset reports that it doesn't.
+// Datasets the user isn't authorized for are passed over, as are beacons
+// that have none of the datasets asked for.
+func (s *BatchSummary) Add(response BeaconResponse) {
+	column, ok := s.column[response.Name]
+	if !ok || response.QueryIndex < 0 || response.QueryIndex >= len(s.Results) {
+		return
+	}
+
+	result := "false"
+	switch {
+	case response.NotQueried != "":
+		result = "notQueried"
+	case len(response.Missing) > 0:
+		result = "unauthorized"
+	case len(response.Error) > 0 || response.Status / 100 != 2:
+		result = "error"
+	case len(response.Results) == 0:
+		result = "unknown"
+	default:
+		for _, r := range response.Results {
+			if len(r.Missing) > 0 {
+				continue
+			}
+			if r.Exists != nil && *r.Exists {
+				result = "true"
+				break
+			} else if r.Exists == nil {
+				result = "unknown"
+			}
+		}
+	}
+
+	s.Results[response.QueryIndex][column] = result
+}
@@ -18,12 +18,15 @@
 package beacon
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -33,28 +36,70 @@ type beaconStruct struct {
 	Name              string                    // Name we give the beacon internally
 	Version           string                    // Beacon API version
 	Endpoint          string                    // URL for beacon
+	Method            string                    // HTTP method for queries, if version supports a choice
+	Granularity       string                    // Requested granularity of results, if version supports it
 	Icon              string                    // Name of icon file in /static/img/
 	DatasetIds        []string                  // Datasets to query
 	AdditionalFields  map[string]string         // Additional query fields to include
 	QueryMap          map[string]string         // Mapping standard names to query fields
+	ChromosomeNaming  string                    // Style of chromosome names beacon expects
+	Assemblies        []string                  // Assemblies beacon holds data for (empty: any)
+	ConnectTimeout    float64                   // Seconds allowed to connect to beacon (0: no limit)
+	ReadTimeout       float64                   // Seconds allowed for beacon to reply (0: no limit)
+	MaxRetries        int                       // Number of times to retry a failed request
+	Backoff           float64                   // Seconds to wait before first retry; doubles each retry
+	RetryStatus       []int                     // HTTP status codes for which to retry
+	FailureThreshold  int                       // Consecutive failures before beacon is skipped
+	ProbeInterval     float64                   // Seconds between health probes of a skipped beacon
+	BatchConcurrency  int                       // Queries of a batch sent to beacon at once
+	Credentials       string                    // What identifies the user: forward, exchange, apiKey or none
+	Audience          string                    // Audience of exchanged tokens (default: beacon's root)
+	Scope             string                    // Scope of exchanged tokens
+	APIKey            string                    // API key sent to beacon
+	APIKeyEnv         string                    // Environment variable with API key
+	APIKeyHeader      string                    // Header in which API key is sent (default: X-API-Key)
+	AllowInsecure     bool                      // Send credentials even to plain HTTP endpoints
+	Requires          []Requirement             // Visas or claims the user needs to query beacon
+	DatasetRequires   map[string][]Requirement  // Visas or claims the user needs, by dataset
+	Request           *customRequest            // Template for requests, for custom beacons
+	Response          *customResponse           // Paths to results in replies, for custom beacons
+	client            *http.Client              // HTTP client configured with the above
+	health            *breaker                  // Circuit breaker tracking beacon health
+	metadata          *metadataCache            // Metadata last fetched from beacon
 }
 
-// Type synonym for query
-type BeaconQuery map[string][]string
-
-// Contains the response from the beacon
+// Contains the response from the beacon. Results are keyed by dataset, or by
+// the beacon's name if it gives only an overall result.
 type BeaconResponse struct {
-	Name       string             `json:"name"` 
-	Status     int                `json:"status"`
-	Icon       string             `json:"icon,omitempty"`
-	Responses  map[string]string  `json:"responses,omitempty"` 
-	Error      map[string]string  `json:"error,omitempty"`              
+	Name             string                      `json:"name"`
+	Status           int                         `json:"status"`
+	Icon             string                      `json:"icon,omitempty"`
+	SchemaVersion    int                         `json:"schemaVersion"`
+	Results          map[string]DatasetResult    `json:"results,omitempty"`
+	Handovers        []Handover                  `json:"handovers,omitempty"`
+	Granularity      string                      `json:"granularity,omitempty"`
+	NumTotalResults  int64                       `json:"numTotalResults,omitempty"`
+	Attempts         int                         `json:"attempts,omitempty"`
+	Health           string                      `json:"health,omitempty"`
+	Cached           bool                        `json:"cached,omitempty"`
+	AssemblyId       string                      `json:"assemblyId,omitempty"`
+	DatasetInfo      map[string]DatasetInfo      `json:"datasetInfo,omitempty"`
+	Query            *BeaconQuery                `json:"query,omitempty"`
+	QueryIndex       int                         `json:"queryIndex"`
+	Error            map[string]string           `json:"error,omitempty"`
+	Missing          []Requirement               `json:"missing,omitempty"`    // What user lacks, if not authorized
+	NotQueried       string                      `json:"notQueried,omitempty"` // Why the beacon wasn't asked, if it wasn't
 }
 
 // Generic interface for beacons
 type beacon interface {
 	initialize()
-	query(query *BeaconQuery, accessToken string, idToken string, ch chan<- BeaconResponse)
+	query(ctx context.Context, query *BeaconQuery, creds *credentials, ch chan<- BeaconResponse)
+}
+
+// Beacons that check and complete their configuration once it has been read
+type configurable interface {
+	configure() error
 }
 
 // List of beacons to be queried
@@ -70,6 +115,24 @@ func Count() int {
 }
 
 
+// Report the names of the configured beacons and their datasets
+func Datasets() map[string][]string {
+	datasets := make(map[string][]string)
+	for _, b := range beacons {
+		c := common(b)
+		datasets[c.Name] = c.DatasetIds
+	}
+	return datasets
+}
+
+
+// Access the structure common to all versions of beacon
+func common(b beacon) *beaconStruct {
+	var nilStruct *beaconStruct
+	return reflect.ValueOf(b).Convert(reflect.TypeOf(nilStruct)).Interface().(*beaconStruct)
+}
+
+
 // Read a configuration file, and create version-appropriate beacon structure
 func AddBeaconFromConfig(file string) {
 
@@ -85,10 +148,34 @@ func AddBeaconFromConfig(file string) {
 		log.Fatal("malformed config file ", file)
 	}
 
+	// Without a version, ask the beacon which version it is
+	version, ok := js["version"].(string)
+	if _, present := js["version"]; present && !ok {
+		log.Fatal("version must be a string in config file ", file)
+	}
+
+	var info *beaconInfo
+	if version == "" || version == "auto" {
+		var probe beaconStruct
+		if err = json.Unmarshal(buffer, &probe); err != nil || probe.Endpoint == "" {
+			log.Fatal("missing endpoint in config file ", file)
+		}
+		probe.client = newClient(&probe)
+
+		if info, err = detectBeacon(&probe); err != nil {
+			log.Print("skipping beacon in config file ", file, ": ", err)
+			return
+		}
+		version = info.version
+	}
+
 	// Create an object of the appropriate version, cast as a generic beacon
-	version := js["version"].(string)
-	beacon := reflect.New(beaconType[version]).Interface().(beacon)
-	
+	t, ok := beaconType[version]
+	if !ok {
+		log.Fatal("unknown beacon version ", version, " in config file ", file)
+	}
+	beacon := reflect.New(t).Interface().(beacon)
+
 	// Initialize it, giving it version-specific defaults
 	beacon.initialize()
 
@@ -97,6 +184,49 @@ func AddBeaconFromConfig(file string) {
 		log.Fatal("malformed config file ", file)
 	}
 
+	// Fill in what the configuration leaves out from what the beacon says
+	if info != nil {
+		info.apply(common(beacon))
+		log.Print("detected version ", version, " beacon ", common(beacon).Name, " at ", common(beacon).Endpoint)
+	}
+	if common(beacon).Name == "" {
+		log.Fatal("missing name in config file ", file)
+	}
+
+	// Let the beacon check and complete its configuration, if it needs to
+	if c, ok := beacon.(configurable); ok {
+		if err := c.configure(); err != nil {
+			log.Fatal(err, " in config file ", file)
+		}
+	}
+
+	// Check how the user is to be identified to the beacon
+	if err := configureCredentials(common(beacon)); err != nil {
+		log.Fatal(err, " in config file ", file)
+	}
+
+	// Check what the beacon requires of users
+	if err := checkRequirements(common(beacon)); err != nil {
+		log.Fatal(err, " in config file ", file)
+	}
+
+	// Check the beacon's chromosome naming style
+	if naming := common(beacon).ChromosomeNaming; naming != "" && !contains(namingStyles, naming) {
+		log.Fatal("unknown chromosome naming style ", naming, " in config file ", file)
+	}
+
+	// Check the assemblies the beacon serves
+	for _, assembly := range common(beacon).Assemblies {
+		if !contains(assemblies, assembly) {
+			log.Fatal("unknown assembly ", assembly, " in config file ", file)
+		}
+	}
+
+	// Set up HTTP client according to the beacon's timeout and retry policy
+	common(beacon).client = newClient(common(beacon))
+	common(beacon).health = newBreaker()
+	common(beacon).metadata = &metadataCache{}
+
 	// Add to the list of beacons to be queried
 	beacons = append(beacons, beacon)
 }
@@ -111,48 +241,25 @@ func addResponseError(response *BeaconResponse, code int, message string) {
 
 
 // Add a valid result to the response
-func addResponseResult(response *BeaconResponse, key string, value string) {
-	response.Responses[key] = value
+func addResponseResult(response *BeaconResponse, key string, value DatasetResult) {
+	response.Results[key] = value
 }
 
 
 
-// Wrapper for HTTP get
-func httpGet(uri string, accessToken string, idToken string) (status int, body []byte, err error) {
-	client := &http.Client{}
-	var request *http.Request
-	
-	if request, err = http.NewRequest("GET", uri, nil); err == nil {
-		request.Header.Add("Accept", "application/json")
-		request.Header.Add("Authorization", "Bearer " + accessToken)
-		request.Header.Add("IDToken", idToken)
-	} else {
-		return
-	}
-
-	var response *http.Response
-	if response, err = client.Do(request); err == nil {
-		defer response.Body.Close()
-	} else {
-		return
-	}
-
-	body, err = ioutil.ReadAll(response.Body)
-	status = response.StatusCode
-	return
-}
-
-
-
-// Pose a given query to all of the configured beacons and await results
-func QueryBeaconsSync(query BeaconQuery, accessToken string, idToken string, timeout int) []byte {
+// Pose a given query to all of the configured beacons and await results.
+// Queries still outstanding at the timeout, or when ctx is cancelled, are abandoned.
+func QueryBeaconsSync(ctx context.Context, query BeaconQuery, principal *Principal, timeout int) []BeaconResponse {
 	num := len(beacons)
 	ch := make(chan BeaconResponse, num)
 	responses := make([]BeaconResponse, 0, num)
 
+	ctx, cancel := context.WithTimeout(ctx, time.Second * time.Duration(timeout))
+	defer cancel()
+
 	// Query each beacon
 	for _, b := range beacons {
-		go b.query(&query, accessToken, idToken, ch)
+		go queryBeacon(ctx, b, &query, principal, ch)
 	}
 
 	// Collect responses, or timeout
@@ -160,21 +267,125 @@ func QueryBeaconsSync(query BeaconQuery, accessToken string, idToken string, tim
 		select {
 		case r := <-ch:
 			responses = append(responses, r)
-		case <- time.After(time.Second * time.Duration(timeout)):
-			break
+		case <- ctx.Done():
+			return responses
 		}
 	}
 
-	// Turn into JSON
-	j, _ := json.Marshal(responses)	
-		
-	return j
+	return responses
 }
 
 
-// Query all beacons, writing results back to channel asynchronously
-func QueryBeaconsAsync(query BeaconQuery, accessToken string, idToken string, ch chan<- BeaconResponse) {
+// Query all beacons, writing results back to channel asynchronously.
+// Cancelling ctx abandons any requests still outstanding.
+func QueryBeaconsAsync(ctx context.Context, query BeaconQuery, principal *Principal, ch chan<- BeaconResponse) {
 	for _, b := range beacons {
-		go b.query(&query, accessToken, idToken, ch)
+		go queryBeacon(ctx, b, &query, principal, ch)
 	}	
 }
+
+
+// Query a single beacon, answering from the cache if possible, and skipping
+// the beacon if its circuit breaker is open. Notes its health in the response.
+// Beacons and datasets the principal isn't authorized for are not asked.
+func queryBeacon(ctx context.Context, b beacon, query *BeaconQuery, principal *Principal, ch chan<- BeaconResponse) {
+	c := common(b)
+
+	// Don't ask a beacon about datasets it doesn't have: it would answer for
+	// all of its own instead
+	if noDatasetsAt(c, query) {
+		response := newResponse(c)
+		response.Status = http.StatusOK
+		response.NotQueried = "none of the requested datasets is at this beacon"
+		response.Health = c.health.current()
+		response.Query = query
+		ch <- *response
+		return
+	}
+
+	// Don't send the query where it would certainly be refused
+	missing, allowed, refused := authorize(c, principal, query)
+	if len(refused) > 0 && len(allowed) == 0 {
+		for _, m := range refused {
+			missing = append(missing, m...)
+		}
+	}
+	if len(missing) > 0 {
+		what := "beacon"
+		if len(refused) > 0 {
+			what = "beacon's datasets"
+		}
+		response := newResponse(c)
+		addResponseError(response, 403, notAuthorized(what, missing))
+		response.Missing = missing
+		response.Health = c.health.current()
+		response.Query = query
+		ch <- *response
+		return
+	}
+
+	// Refuse, rather than degrade, queries the beacon cannot express
+	if unsupported := unsupportedParams(c, query); len(unsupported) > 0 {
+		response := newResponse(c)
+		addResponseError(response, 501, fmt.Sprintf("unsupported: version %s beacons cannot answer %s",
+			c.Version, strings.Join(unsupported, " or ")))
+		response.Health = c.health.current()
+		response.Query = query
+		ch <- *response
+		return
+	}
+
+	// Lift the query to an assembly the beacon serves
+	local := *query
+	if query.AssemblyId != "" && len(c.Assemblies) > 0 && !contains(c.Assemblies, query.AssemblyId) {
+		lifted, err := liftQuery(query, c.Assemblies[0])
+		if err != nil {
+			response := newResponse(c)
+			addResponseError(response, 422, "cannot query in " + c.Assemblies[0] + ": " + err.Error())
+			response.Health = c.health.current()
+			response.Query = query
+			ch <- *response
+			return
+		}
+		local = *lifted
+	}
+
+	// Spell the chromosome as the beacon expects, and leave out datasets the
+	// principal isn't authorized for
+	local.ReferenceName = chromosomeName(c.ChromosomeNaming, local.ReferenceName, local.AssemblyId)
+	if len(refused) > 0 {
+		local.DatasetIds = allowed
+	}
+
+	response := cachedQuery(ctx, c, &local, principal, func() BeaconResponse {
+		if c.health.current() == breakerOpen {
+			response := newResponse(c)
+			addResponseError(response, 503, "temporarily unavailable")
+			return *response
+		}
+
+		creds, err := beaconCredentials(ctx, c, principal)
+		if err != nil {
+			response := newResponse(c)
+			addResponseError(response, 401, "unable to obtain credentials for this beacon: " + err.Error())
+			return *response
+		}
+
+		inner := make(chan BeaconResponse, 1)
+		b.query(ctx, &local, creds, inner)
+		return <-inner
+	})
+
+	if len(refused) > 0 && len(response.Error) == 0 {
+		response.Results = copyResults(response.Results)
+		for d, m := range refused {
+			addResponseResult(&response, d, DatasetResult{Error: notAuthorized("dataset", m), Missing: m})
+		}
+	}
+
+	response.Health = c.health.current()
+	response.AssemblyId = local.AssemblyId
+	response.DatasetInfo = c.metadata.forResponse(c.Name, &response)
+	response.Query = query
+	ch <- response
+}
@@ -0,0 +1,328 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// Beacons with non-standard APIs, described entirely by their configuration:
+// a template for the request, and paths to the results in the reply
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Type alias for this version
+type beaconCustom beaconStruct
+
+// Template for the request to a custom beacon. Templates name the query's
+// values in braces, by their standard names: {chromosome}, {start},
+// {datasetIds}, and so on; the URL may also name the {endpoint}.
+type customRequest struct {
+	URL    string             // URL, by default {endpoint}
+	Query  map[string]string  // Query string parameters
+	Body   interface{}        // JSON document to POST
+}
+
+// Paths (in a subset of JSONPath) to the results in a custom beacon's reply
+type customResponse struct {
+	Exists        string            // Whether the variant was found
+	VariantCount  string            // Number of matching variants
+	SampleCount   string            // Number of samples with the variant
+	Frequency     string            // Allele frequency
+	Error         string            // Error, as a message, code or object; false or empty means none
+	Datasets      *customDatasets   // Results for each dataset, if reported
+}
+
+// Paths to per-dataset results: the list of them, then paths within each
+type customDatasets struct {
+	Path          string
+	Id            string
+	Exists        string
+	VariantCount  string
+	SampleCount   string
+	Frequency     string
+}
+
+
+// Placeholders for query values in templates
+var placeholderPattern = regexp.MustCompile(`\{([A-Za-z]+)\}`)
+
+
+// Register this version's type
+func init() {
+	var nilStruct *beaconCustom
+	beaconType["custom"] = reflect.TypeOf(nilStruct).Elem()
+}
+
+
+// Initialize the beacon with defaults appropriate for this version
+func (beacon *beaconCustom) initialize() {
+	beacon.Method = "GET"
+	beacon.QueryMap = make(map[string]string)
+	beacon.QueryMap["GRCh37"] = "GRCh37"
+	beacon.QueryMap["GRCh38"] = "GRCh38"
+}
+
+
+// Check the request template and response paths, and note which standard
+// fields the template can express, so that queries it can't are refused
+func (beacon *beaconCustom) configure() error {
+	if beacon.Request == nil || beacon.Response == nil {
+		return errors.New("custom beacons need request and response descriptions")
+	}
+
+	method := strings.ToUpper(beacon.Method)
+	if method != "GET" && method != "POST" {
+		return fmt.Errorf("unsupported method %s", beacon.Method)
+	}
+	if beacon.Request.URL == "" {
+		beacon.Request.URL = "{endpoint}"
+	}
+
+	templates := []string{beacon.Request.URL}
+	for _, v := range beacon.Request.Query {
+		templates = append(templates, v)
+	}
+	body, _ := json.Marshal(beacon.Request.Body)
+	templates = append(templates, string(body))
+
+	for _, t := range templates {
+		for _, m := range placeholderPattern.FindAllStringSubmatch(t, -1) {
+			if m[1] != "endpoint" {
+				beacon.QueryMap[m[1]] = m[1]
+			}
+		}
+	}
+
+	r := beacon.Response
+	paths := []string{r.Exists, r.VariantCount, r.SampleCount, r.Frequency, r.Error}
+	if r.Datasets != nil {
+		d := r.Datasets
+		if d.Path == "" || d.Id == "" {
+			return errors.New("custom beacon datasets need a path and an id")
+		}
+		paths = append(paths, d.Path, d.Id, d.Exists, d.VariantCount, d.SampleCount, d.Frequency)
+	} else if r.Exists == "" {
+		return errors.New("custom beacons need a path to exists, or to datasets")
+	}
+
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		if err := checkJSONPath(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+
+func (beacon *beaconCustom) query(ctx context.Context, query *BeaconQuery, creds *credentials, ch chan<- BeaconResponse) {
+	var status, attempts int
+	var body []byte
+	var err error
+
+	values := beacon.templateValues(query)
+
+	// The endpoint is a URL in its own right, so it is not escaped
+	template := strings.Replace(beacon.Request.URL, "{endpoint}", beacon.Endpoint, -1)
+	uri, ok := fillTemplate(template, values, url.PathEscape)
+	if !ok {
+		resp := newResponse((*beaconStruct)(beacon))
+		addResponseError(resp, 501, "unsupported: query lacks fields the beacon requires")
+		ch <- *resp
+		return
+	}
+	if qs := beacon.queryString(values); qs != "" {
+		uri = fmt.Sprintf("%s?%s", uri, qs)
+	}
+
+	if strings.ToUpper(beacon.Method) == "POST" {
+		document, _ := fillBody(beacon.Request.Body, values)
+		status, body, attempts, err = httpPost(ctx, (*beaconStruct)(beacon), uri, document, creds)
+	} else {
+		status, body, attempts, err = httpGet(ctx, (*beaconStruct)(beacon), uri, creds)
+	}
+
+	resp := beacon.parseResponse(status, body, err)
+	resp.Attempts = attempts
+
+	ch <- *resp
+}
+
+
+// Values that templates may name, by standard name
+func (beacon *beaconCustom) templateValues(query *BeaconQuery) map[string]interface{} {
+	values := make(map[string]interface{})
+
+	for _, p := range query.params() {
+		if _, v, ok := mapParam((*beaconStruct)(beacon), p); ok {
+			values[p.name] = v
+		}
+	}
+
+	if datasets := queryDatasets((*beaconStruct)(beacon), query); len(datasets) > 0 {
+		values["datasetIds"] = datasets
+	}
+
+	return values
+}
+
+
+// Construct the query string, leaving out parameters whose values the query
+// doesn't have; a list of datasets gives a parameter for each
+func (beacon *beaconCustom) queryString(values map[string]interface{}) string {
+	qv := url.Values{}
+
+	for k, t := range beacon.Request.Query {
+		if datasets, ok := values["datasetIds"].([]string); ok && t == "{datasetIds}" {
+			qv[k] = datasets
+		} else if v, ok := fillTemplate(t, values, nil); ok {
+			qv.Set(k, v)
+		}
+	}
+
+	for k, v := range beacon.AdditionalFields {
+		qv.Set(k, v)
+	}
+
+	return qv.Encode()
+}
+
+
+// Fill in the placeholders in a template string, escaping the values if
+// necessary. The result is false if the template names a missing value.
+func fillTemplate(template string, values map[string]interface{}, escape func(string) string) (string, bool) {
+	ok := true
+	filled := placeholderPattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		v, found := values[strings.Trim(placeholder, "{}")]
+		if !found {
+			ok = false
+			return ""
+		}
+
+		s := fmt.Sprint(v)
+		if list, isList := v.([]string); isList {
+			s = strings.Join(list, ",")
+		}
+		if escape != nil {
+			s = escape(s)
+		}
+		return s
+	})
+	return filled, ok
+}
+
+
+// Fill in a body template. A string consisting only of a placeholder is
+// replaced by the value itself, so positions stay numbers and datasets a list;
+// members whose values the query doesn't have are left out.
+func fillBody(template interface{}, values map[string]interface{}) (interface{}, bool) {
+	switch t := template.(type) {
+	case string:
+		if m := placeholderPattern.FindStringSubmatch(t); m != nil && m[0] == t {
+			v, found := values[m[1]]
+			return v, found
+		}
+		return fillTemplate(t, values, nil)
+
+	case map[string]interface{}:
+		filled := make(map[string]interface{})
+		for k, v := range t {
+			if fv, ok := fillBody(v, values); ok {
+				filled[k] = fv
+			}
+		}
+		return filled, true
+
+	case []interface{}:
+		filled := make([]interface{}, 0, len(t))
+		for _, v := range t {
+			if fv, ok := fillBody(v, values); ok {
+				filled = append(filled, fv)
+			}
+		}
+		return filled, true
+	}
+
+	return template, true
+}
+
+
+func (beacon *beaconCustom) parseResponse(status int, raw []byte, err error) *BeaconResponse {
+	response := newResponse((*beaconStruct)(beacon))
+
+	if err != nil {
+		addResponseError(response, 400, "could not reach beacon")
+		return response
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		if status/100 != 2 {
+			addResponseError(response, status, "beacon error")
+		} else {
+			addResponseError(response, 400, "malformed reply from beacon")
+		}
+		return response
+	}
+
+	r := beacon.Response
+	if code, message, ok := parseError(jsonPathFirst(doc, r.Error)); ok {
+		if code == 0 {
+			code = status
+		}
+		addResponseError(response, code, message)
+		return response
+	}
+
+	if status/100 != 2 {
+		addResponseError(response, status, "beacon error")
+		return response
+	}
+
+	response.Status = status
+
+	// Without dataset results, report the overall result under the beacon's name
+	if r.Datasets == nil {
+		result := DatasetResult{Exists: existsValue(jsonPathFirst(doc, r.Exists))}
+		fillCounts(&result, doc, r.VariantCount, "", r.SampleCount, r.Frequency)
+		addResponseResult(response, beacon.Name, result)
+		return response
+	}
+
+	for _, ds := range jsonPath(doc, r.Datasets.Path) {
+		id := jsonPathFirst(ds, r.Datasets.Id)
+		if id == nil {
+			continue
+		}
+
+		result := DatasetResult{Exists: existsValue(jsonPathFirst(ds, r.Datasets.Exists))}
+		fillCounts(&result, ds, r.Datasets.VariantCount, "", r.Datasets.SampleCount, r.Datasets.Frequency)
+		addResponseResult(response, fmt.Sprint(id), result)
+	}
+
+	return response
+}
@@ -0,0 +1,144 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// Specific implementations for version 1.0 beacons
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// Type alias for this version
+type beaconV1 beaconStruct
+
+// Register this version's type
+func init() {
+	var nilStruct *beaconV1
+	beaconType["1.0"] = reflect.TypeOf(nilStruct).Elem()
+}
+
+// Initialize the beacon with defaults appropriate for this version
+func (beacon *beaconV1) initialize() {
+	beacon.Method = "GET"
+	beacon.QueryMap = make(map[string]string)
+	beacon.QueryMap["chromosome"]     = "referenceName"
+	beacon.QueryMap["start"]          = "start"
+	beacon.QueryMap["end"]            = "end"
+	beacon.QueryMap["startMin"]       = "startMin"
+	beacon.QueryMap["startMax"]       = "startMax"
+	beacon.QueryMap["endMin"]         = "endMin"
+	beacon.QueryMap["endMax"]         = "endMax"
+	beacon.QueryMap["alternateBases"] = "alternateBases"
+	beacon.QueryMap["referenceBases"] = "referenceBases"
+	beacon.QueryMap["variantType"]    = "variantType"
+	beacon.QueryMap["datasetIds"]     = "datasetIds"
+	beacon.QueryMap["assemblyId"]     = "assemblyId"
+	beacon.QueryMap["GRCh37"]         = "GRCh37"
+	beacon.QueryMap["GRCh38"]         = "GRCh38"
+	beacon.AdditionalFields = make(map[string]string)
+	beacon.AdditionalFields["includeDatasetResponses"] = "ALL"
+}
+
+
+func (beacon *beaconV1) parseResponse(status int, raw []byte, err error) *BeaconResponse {
+	response := newResponse((*beaconStruct)(beacon))
+
+	if err != nil {
+		addResponseError(response, 400, "could not reach beacon")
+		return response
+	}
+
+	parseAlleleResponse(response, status, raw)
+	return response
+}
+
+
+func (beacon *beaconV1) query(ctx context.Context, query *BeaconQuery, creds *credentials, ch chan<- BeaconResponse) {
+	var status, attempts int
+	var body []byte
+	var err error
+
+	if strings.ToUpper(beacon.Method) == "POST" {
+		status, body, attempts, err = httpPost(ctx, (*beaconStruct)(beacon), beacon.Endpoint, beacon.queryBody(query), creds)
+	} else {
+		uri := fmt.Sprintf("%s?%s", beacon.Endpoint, beacon.queryString(query))
+		status, body, attempts, err = httpGet(ctx, (*beaconStruct)(beacon), uri, creds)
+	}
+
+	resp := beacon.parseResponse(status, body, err)
+	resp.Attempts = attempts
+
+	ch <- *resp
+}
+
+
+// Construct the query string
+func (beacon *beaconV1) queryString(query *BeaconQuery) string {
+	ql := make([]string, 0, 20)
+
+	for _, d := range queryDatasets((*beaconStruct)(beacon), query) {
+		ql = append(ql, fmt.Sprintf("%s=%s", beacon.QueryMap["datasetIds"], url.QueryEscape(d)))
+	}
+
+	for _, p := range query.params() {
+		if k, v, ok := mapParam((*beaconStruct)(beacon), p); ok {
+			ql = append(ql, fmt.Sprintf("%s=%s", k, url.QueryEscape(fmt.Sprint(v))))
+		}
+	}
+
+	// Version 1.0 requires referenceBases; structural variants use N
+	if query.VariantType != "" && query.ReferenceBases == "" {
+		ql = append(ql, fmt.Sprintf("%s=N", beacon.QueryMap["referenceBases"]))
+	}
+
+	for k2, v2 := range beacon.AdditionalFields {
+		ql = append(ql, fmt.Sprintf("%s=%s", k2, v2))
+	}
+
+	return strings.Join(ql, "&")
+}
+
+
+// Construct the JSON body for a POST query
+func (beacon *beaconV1) queryBody(query *BeaconQuery) map[string]interface{} {
+	body := make(map[string]interface{})
+
+	if datasets := queryDatasets((*beaconStruct)(beacon), query); len(datasets) > 0 {
+		body[beacon.QueryMap["datasetIds"]] = datasets
+	}
+
+	for _, p := range query.params() {
+		if k, v, ok := mapParam((*beaconStruct)(beacon), p); ok {
+			body[k] = v
+		}
+	}
+
+	if query.VariantType != "" && query.ReferenceBases == "" {
+		body[beacon.QueryMap["referenceBases"]] = "N"
+	}
+
+	for k2, v2 := range beacon.AdditionalFields {
+		body[k2] = v2
+	}
+
+	return body
+}
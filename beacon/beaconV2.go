@@ -20,8 +20,10 @@ package beacon
 // Specific implementations for version 0.2 beacons
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"reflect"
 	"strings"
 )
@@ -49,10 +51,7 @@ func (beacon *beaconV2) initialize() {
 }
 
 func (beacon *beaconV2) parseResponse(status int, raw []byte, err error) *BeaconResponse {
-	response := &BeaconResponse{Name: beacon.Name,
-		Icon: beacon.Icon, 
-		Responses: make(map[string]string),
-		Error: make(map[string]string)}
+	response := newResponse((*beaconStruct)(beacon))
 
 	if err != nil {
 		addResponseError(response, 400, "could not reach beacon")
@@ -64,14 +63,14 @@ func (beacon *beaconV2) parseResponse(status int, raw []byte, err error) *Beacon
 		return response
 	}
 
-	var v2 struct {Response map[string]string}
+	var v2 struct {Response map[string]interface{}}
 
 	if err := json.Unmarshal(raw, &v2); err == nil {
-		if v2.Response["error"] == "" {
+		if e := stringValue(v2.Response["error"]); e == "" {
 			response.Status = status
-			addResponseResult(response, beacon.Name, v2.Response["exists"])
+			addResponseResult(response, beacon.Name, DatasetResult{Exists: existsValue(v2.Response["exists"])})
 		} else {
-			addResponseError(response, 400, v2.Response["error"])
+			addResponseError(response, 400, e)
 		}
 	} else {
 		addResponseError(response, 400, "malformed reply from beacon")
@@ -81,12 +80,13 @@ func (beacon *beaconV2) parseResponse(status int, raw []byte, err error) *Beacon
 }
 
 
-func (beacon *beaconV2) query(query *BeaconQuery, accessToken string, idToken string, ch chan<- BeaconResponse) {
+func (beacon *beaconV2) query(ctx context.Context, query *BeaconQuery, creds *credentials, ch chan<- BeaconResponse) {
 	qs := beacon.queryString(query)
 	uri := fmt.Sprintf("%s?%s", beacon.Endpoint, qs)
 
-	status, body, err := httpGet(uri, accessToken, idToken)
+	status, body, attempts, err := httpGet(ctx, (*beaconStruct)(beacon), uri, creds)
 	resp := beacon.parseResponse(status, body, err)
+	resp.Attempts = attempts
 
 	ch <- *resp
 }
@@ -97,15 +97,13 @@ func (beacon *beaconV2) queryString(query *BeaconQuery) string {
 	ql := make([]string, 0, 20)
 	
 	// Add datasets
-	for _, d := range beacon.DatasetIds {
-		ql = append(ql, fmt.Sprintf("%s=%s", beacon.QueryMap["datasetIds"], d))
+	for _, d := range queryDatasets((*beaconStruct)(beacon), query) {
+		ql = append(ql, fmt.Sprintf("%s=%s", beacon.QueryMap["datasetIds"], url.QueryEscape(d)))
 	}
 
-	for k, v := range *query {
-		if k == "assemblyId" {
-			ql = append(ql, fmt.Sprintf("%s=%s", beacon.QueryMap[k], beacon.QueryMap[v[0]]))
-		} else {
-			ql = append(ql, fmt.Sprintf("%s=%s", beacon.QueryMap[k], v[0]))
+	for _, p := range query.params() {
+		if k, v, ok := mapParam((*beaconStruct)(beacon), p); ok {
+			ql = append(ql, fmt.Sprintf("%s=%s", k, url.QueryEscape(fmt.Sprint(v))))
 		}
 	}
 
@@ -0,0 +1,223 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// Specific implementations for version 2.0 beacons (Beacon Framework / Models)
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// Type alias for this version
+type beaconV20 beaconStruct
+
+// Register this version's type
+func init() {
+	var nilStruct *beaconV20
+	beaconType["2.0"] = reflect.TypeOf(nilStruct).Elem()
+}
+
+// Initialize the beacon with defaults appropriate for this version
+func (beacon *beaconV20) initialize() {
+	beacon.Method = "GET"
+	beacon.Granularity = "boolean"
+	beacon.QueryMap = make(map[string]string)
+	beacon.QueryMap["chromosome"]     = "referenceName"
+	beacon.QueryMap["start"]          = "start"
+	beacon.QueryMap["end"]            = "end"
+	beacon.QueryMap["startMin"]       = "start"
+	beacon.QueryMap["startMax"]       = "start"
+	beacon.QueryMap["endMin"]         = "end"
+	beacon.QueryMap["endMax"]         = "end"
+	beacon.QueryMap["alternateBases"] = "alternateBases"
+	beacon.QueryMap["referenceBases"] = "referenceBases"
+	beacon.QueryMap["variantType"]    = "variantType"
+	beacon.QueryMap["datasetIds"]     = "datasetIds"
+	beacon.QueryMap["assemblyId"]     = "assemblyId"
+	beacon.QueryMap["GRCh37"]         = "GRCh37"
+	beacon.QueryMap["GRCh38"]         = "GRCh38"
+}
+
+
+func (beacon *beaconV20) parseResponse(status int, raw []byte, err error) *BeaconResponse {
+	response := newResponse((*beaconStruct)(beacon))
+
+	if err != nil {
+		addResponseError(response, 400, "could not reach beacon")
+		return response
+	}
+
+	// Errors may be described in the body of a non-2xx reply
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		if status/100 != 2 {
+			addResponseError(response, status, "beacon error")
+		} else {
+			addResponseError(response, 400, "malformed reply from beacon")
+		}
+		return response
+	}
+
+	if code, message, ok := parseError(jsonPathFirst(doc, "$.error")); ok {
+		if code == 0 {
+			code = status
+		}
+		addResponseError(response, code, message)
+		return response
+	}
+
+	if status/100 != 2 {
+		addResponseError(response, status, "beacon error")
+		return response
+	}
+
+	response.Status = status
+	response.Granularity = stringValue(jsonPathFirst(doc, "$.meta.returnedGranularity"))
+	if n, ok := numberValue(jsonPathFirst(doc, "$.responseSummary.numTotalResults")); ok {
+		response.NumTotalResults = int64(n)
+	}
+	response.Handovers = parseHandovers(jsonPathFirst(doc, "$.beaconHandovers"))
+
+	// Boolean responses carry no result sets; report the summary under the beacon's name
+	resultSets := jsonPath(doc, "$.response.resultSets[*]")
+	if len(resultSets) == 0 {
+		addResponseResult(response, beacon.Name, DatasetResult{Exists: existsValue(jsonPathFirst(doc, "$.responseSummary.exists"))})
+		return response
+	}
+
+	for _, r := range resultSets {
+		id := stringValue(jsonPathFirst(r, "$.id"))
+		if id == "" {
+			continue
+		}
+
+		result := DatasetResult{
+			Exists: existsValue(jsonPathFirst(r, "$.exists")),
+			SetType: stringValue(jsonPathFirst(r, "$.setType")),
+			Info: jsonPathFirst(r, "$.info"),
+			Handovers: parseHandovers(jsonPathFirst(r, "$.resultsHandovers")),
+		}
+		if n, ok := numberValue(jsonPathFirst(r, "$.resultsCount")); ok {
+			count := int64(n)
+			result.VariantCount = &count
+		}
+		addResponseResult(response, id, result)
+	}
+
+	return response
+}
+
+
+func (beacon *beaconV20) query(ctx context.Context, query *BeaconQuery, creds *credentials, ch chan<- BeaconResponse) {
+	var status, attempts int
+	var body []byte
+	var err error
+
+	uri := strings.TrimSuffix(beacon.Endpoint, "/") + "/g_variants"
+
+	if strings.ToUpper(beacon.Method) == "POST" {
+		status, body, attempts, err = httpPost(ctx, (*beaconStruct)(beacon), uri, beacon.queryBody(query), creds)
+	} else {
+		uri = fmt.Sprintf("%s?%s", uri, beacon.queryString(query))
+		status, body, attempts, err = httpGet(ctx, (*beaconStruct)(beacon), uri, creds)
+	}
+
+	resp := beacon.parseResponse(status, body, err)
+	resp.Attempts = attempts
+
+	ch <- *resp
+}
+
+
+// Construct the query string
+func (beacon *beaconV20) queryString(query *BeaconQuery) string {
+	ql := make([]string, 0, 20)
+
+	if datasets := queryDatasets((*beaconStruct)(beacon), query); len(datasets) > 0 {
+		ql = append(ql, fmt.Sprintf("%s=%s", beacon.QueryMap["datasetIds"], url.QueryEscape(strings.Join(datasets, ","))))
+	}
+
+	// Positions are lists in version 2.0: a range's bounds are given as
+	// two values for the same parameter
+	positions := make(map[string][]string)
+	order := make([]string, 0, 2)
+	for _, p := range query.params() {
+		if k, v, ok := mapParam((*beaconStruct)(beacon), p); ok {
+			if _, isNumber := v.(int64); isNumber {
+				if _, seen := positions[k]; !seen {
+					order = append(order, k)
+				}
+				positions[k] = append(positions[k], fmt.Sprint(v))
+			} else {
+				ql = append(ql, fmt.Sprintf("%s=%s", k, url.QueryEscape(fmt.Sprint(v))))
+			}
+		}
+	}
+	for _, k := range order {
+		ql = append(ql, fmt.Sprintf("%s=%s", k, strings.Join(positions[k], ",")))
+	}
+
+	ql = append(ql, fmt.Sprintf("requestedGranularity=%s", beacon.Granularity))
+
+	for k2, v2 := range beacon.AdditionalFields {
+		ql = append(ql, fmt.Sprintf("%s=%s", k2, v2))
+	}
+
+	return strings.Join(ql, "&")
+}
+
+
+// Construct the JSON body for a POST query
+func (beacon *beaconV20) queryBody(query *BeaconQuery) map[string]interface{} {
+	params := make(map[string]interface{})
+
+	if datasets := queryDatasets((*beaconStruct)(beacon), query); len(datasets) > 0 {
+		params[beacon.QueryMap["datasetIds"]] = datasets
+	}
+
+	for _, p := range query.params() {
+		if k, v, ok := mapParam((*beaconStruct)(beacon), p); ok {
+			// Positions are arrays in version 2.0, to allow for ranges
+			if n, isNumber := v.(int64); isNumber {
+				ps, _ := params[k].([]int64)
+				params[k] = append(ps, n)
+			} else {
+				params[k] = v
+			}
+		}
+	}
+
+	for k2, v2 := range beacon.AdditionalFields {
+		params[k2] = v2
+	}
+
+	return map[string]interface{}{
+		"meta": map[string]interface{}{
+			"apiVersion": "2.0",
+		},
+		"query": map[string]interface{}{
+			"requestParameters":    params,
+			"requestedGranularity": beacon.Granularity,
+		},
+	}
+}
@@ -20,10 +20,10 @@ package beacon
 // Specific implementations for version 0.3 beacons
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"net/url"
 	"reflect"
-	"strconv"
 	"strings"
 )
 
@@ -51,61 +51,25 @@ func (beacon *beaconV3) initialize() {
 
 
 func (beacon *beaconV3) parseResponse(status int, raw []byte, err error) *BeaconResponse {
-	response := &BeaconResponse{Name: beacon.Name,
-		Icon: beacon.Icon,
-		Responses: make(map[string]string),
-		Error: make(map[string]string)}
+	response := newResponse((*beaconStruct)(beacon))
 
 	if err != nil {
 		addResponseError(response, 400, "could not reach beacon")
 		return response		
 	}
 
-	if status/100 != 2 {
-		addResponseError(response, status, "beacon error")
-		return response
-	}
-
-	var v3 struct {
-		BeaconId                string                    `json:"beaconId"`
-		Exists                  bool                      `json:"exists"`
-		Error                   map[string]string         `json:"error,omitempty"`
-		AlleleRequest           map [string]interface{}   `json:"alleleRequest,omitempty"`
-		DatasetAlleleResponses  []map[string]interface{}  `json:"datasetAlleleResponses,omitempty"`
-	}
-
-	if err := json.Unmarshal(raw, &v3); err == nil {
-		if v3.Error == nil {
-			response.Status = status
-			for _, r := range v3.DatasetAlleleResponses {
-				var ex string
-				if r["exists"].(bool) {
-					ex = "true"
-				} else {
-					ex = "false"
-				}
-				
-				id := r["datasetId"].(string)
-				addResponseResult(response, id, ex)
-			}
-		} else {
-			code, _ := strconv.Atoi(v3.Error["errorCode"])
-			addResponseError(response, code, v3.Error["message"])
-		}
-	} else {
-		addResponseError(response, 400, "malformed reply from beacon")
-	}
-
+	parseAlleleResponse(response, status, raw)
 	return response
 }
 
 
-func (beacon *beaconV3) query(query *BeaconQuery, accessToken string, idToken string, ch chan<- BeaconResponse) {
+func (beacon *beaconV3) query(ctx context.Context, query *BeaconQuery, creds *credentials, ch chan<- BeaconResponse) {
 	qs := beacon.queryString(query)
 	uri := fmt.Sprintf("%s?%s", beacon.Endpoint, qs)
 
-	status, body, err := httpGet(uri, accessToken, idToken)
+	status, body, attempts, err := httpGet(ctx, (*beaconStruct)(beacon), uri, creds)
 	resp := beacon.parseResponse(status, body, err)
+	resp.Attempts = attempts
 
 	ch <- *resp
 }
@@ -115,15 +79,13 @@ func (beacon *beaconV3) query(query *BeaconQuery, accessToken string, idToken st
 func (beacon *beaconV3) queryString(query *BeaconQuery) string {
 	ql := make([]string, 0, 20)
 
-	for _, d := range beacon.DatasetIds {
-		ql = append(ql, fmt.Sprintf("%s=%s", beacon.QueryMap["datasetIds"], d))
+	for _, d := range queryDatasets((*beaconStruct)(beacon), query) {
+		ql = append(ql, fmt.Sprintf("%s=%s", beacon.QueryMap["datasetIds"], url.QueryEscape(d)))
 	}
 		
-	for k, v := range *query {
-		if k == "assemblyId" {
-			ql = append(ql, fmt.Sprintf("%s=%s", beacon.QueryMap[k], beacon.QueryMap[v[0]]))
-		} else {
-			ql = append(ql, fmt.Sprintf("%s=%s", beacon.QueryMap[k], v[0]))
+	for _, p := range query.params() {
+		if k, v, ok := mapParam((*beaconStruct)(beacon), p); ok {
+			ql = append(ql, fmt.Sprintf("%s=%s", k, url.QueryEscape(fmt.Sprint(v))))
 		}
 	}
 
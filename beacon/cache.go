@@ -0,0 +1,298 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// Cache of beacon responses, with coalescing of identical in-flight queries
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+
+// Storage for cached responses
+type cacheBackend interface {
+	get(key string) (BeaconResponse, bool)
+	put(key string, response BeaconResponse, ttl time.Duration)
+}
+
+// A cached response and its expiry time
+type cacheEntry struct {
+	Expires   time.Time       `json:"expires"`
+	Response  BeaconResponse  `json:"response"`
+}
+
+// In-memory cache backend
+type memoryCache struct {
+	mutex     sync.Mutex
+	entries   map[string]cacheEntry
+	puts      int                               // Puts since expired entries were last swept
+}
+
+// On-disk cache backend, one file per entry
+type diskCache struct {
+	dir       string
+}
+
+// A query in flight, which identical queries may wait on
+type flight struct {
+	done      chan struct{}                     // Closed when the response is available
+	response  BeaconResponse                    // Response to the query
+	abandoned bool                              // Query was cancelled; waiters must retry
+}
+
+
+// Cache configuration and state
+var cache struct {
+	backend      cacheBackend                   // Where responses are stored; nil if disabled
+	ttl          time.Duration                  // Lifetime of positive responses
+	negativeTTL  time.Duration                  // Lifetime of negative responses
+	mutex        sync.Mutex
+	inflight     map[string]*flight             // Queries in progress, by cache key
+}
+
+// Number of puts between sweeps of expired in-memory entries
+const sweepInterval = 1000
+
+
+// Initialize module globals
+func init() {
+	cache.inflight = make(map[string]*flight)
+}
+
+
+// Enable caching of beacon responses. Positive responses are kept for ttl
+// seconds, and negative responses for negativeTTL seconds. Responses are
+// kept in memory, or in files in dir if it is not empty.
+func ConfigureCache(ttl int, negativeTTL int, dir string) error {
+	cache.ttl = time.Duration(ttl) * time.Second
+	cache.negativeTTL = time.Duration(negativeTTL) * time.Second
+
+	if ttl <= 0 && negativeTTL <= 0 {
+		cache.backend = nil
+		return nil
+	}
+
+	if dir == "" {
+		cache.backend = &memoryCache{entries: make(map[string]cacheEntry)}
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	cache.backend = &diskCache{dir: dir}
+	return nil
+}
+
+
+// Answer a query from the cache if possible. Otherwise, perform it -- or wait
+// for an identical query already in flight -- and cache the response.
+// Queries with tokens that haven't been verified bypass the cache, since
+// there is no telling whose responses they would share.
+func cachedQuery(ctx context.Context, b *beaconStruct, query *BeaconQuery, p *Principal, perform func() BeaconResponse) BeaconResponse {
+	if cache.backend == nil {
+		return perform()
+	}
+	if p.Subject == "" && (p.AccessToken != "" || p.IDToken != "") {
+		return perform()
+	}
+
+	key := cacheKey(b, query, p.Subject)
+
+	if response, ok := cache.backend.get(key); ok {
+		response.Cached = true
+		return response
+	}
+
+	for {
+		// A query given up already, perhaps while waiting, isn't sent
+		if ctx.Err() != nil {
+			return abandonedResponse(ctx, b)
+		}
+
+		cache.mutex.Lock()
+		f, waiting := cache.inflight[key]
+		if !waiting {
+			f = &flight{done: make(chan struct{})}
+			cache.inflight[key] = f
+		}
+		cache.mutex.Unlock()
+
+		// Another identical query is in flight; wait for it
+		if waiting {
+			select {
+			case <- f.done:
+				if !f.abandoned {
+					return f.response
+				}
+				continue
+			case <- ctx.Done():
+				return abandonedResponse(ctx, b)
+			}
+		}
+
+		// Perform the query ourselves, and share the response
+		f.response = perform()
+		f.abandoned = ctx.Err() != nil
+
+		if !f.abandoned {
+			if ttl := cacheTTL(f.response); ttl > 0 {
+				cache.backend.put(key, f.response, ttl)
+			}
+		}
+
+		cache.mutex.Lock()
+		delete(cache.inflight, key)
+		cache.mutex.Unlock()
+		close(f.done)
+
+		return f.response
+	}
+}
+
+
+// Response for a query given up while waiting on an identical one. It is
+// never sent to the beacon, so says nothing of the beacon's health.
+func abandonedResponse(ctx context.Context, b *beaconStruct) BeaconResponse {
+	response := newResponse(b)
+	if ctx.Err() == context.DeadlineExceeded {
+		addResponseError(response, http.StatusGatewayTimeout, "timed out waiting for the beacon")
+	} else {
+		addResponseError(response, http.StatusServiceUnavailable, "query cancelled")
+	}
+	return *response
+}
+
+
+// Lifetime of a response in the cache; errors are not cached at all
+func cacheTTL(response BeaconResponse) time.Duration {
+	if len(response.Error) > 0 || response.Status/100 != 2 {
+		return 0
+	}
+
+	for _, r := range response.Results {
+		if r.Exists == nil || *r.Exists {
+			return cache.ttl
+		}
+	}
+	return cache.negativeTTL
+}
+
+
+// Key for the cache: the beacon, the normalized query, and the verified
+// subject of the principal, since beacons may answer differently for
+// different principals. The schema version keeps responses cached in an
+// older form from being used.
+func cacheKey(b *beaconStruct, query *BeaconQuery, subject string) string {
+	q := *query
+	q.DatasetIds = append([]string(nil), query.DatasetIds...)
+	sort.Strings(q.DatasetIds)
+
+	js, _ := json.Marshal(struct {
+		Beacon  string       `json:"beacon"`
+		Query   BeaconQuery  `json:"query"`
+		Scope   string       `json:"scope"`
+		Schema  int          `json:"schema"`
+	}{b.Name, q, subject, ResponseSchemaVersion})
+
+	sum := sha256.Sum256(js)
+	return hex.EncodeToString(sum[:])
+}
+
+
+// Look up an unexpired response in memory
+func (m *memoryCache) get(key string) (BeaconResponse, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok || time.Now().After(e.Expires) {
+		return BeaconResponse{}, false
+	}
+	return e.Response, true
+}
+
+
+// Store a response in memory, occasionally sweeping out expired entries
+func (m *memoryCache) put(key string, response BeaconResponse, ttl time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.entries[key] = cacheEntry{time.Now().Add(ttl), response}
+
+	if m.puts++; m.puts >= sweepInterval {
+		m.puts = 0
+		now := time.Now()
+		for k, e := range m.entries {
+			if now.After(e.Expires) {
+				delete(m.entries, k)
+			}
+		}
+	}
+}
+
+
+// Look up an unexpired response on disk, removing it if expired
+func (d *diskCache) get(key string) (BeaconResponse, bool) {
+	file := filepath.Join(d.dir, key + ".json")
+
+	buffer, err := ioutil.ReadFile(file)
+	if err != nil {
+		return BeaconResponse{}, false
+	}
+
+	var e cacheEntry
+	if err := json.Unmarshal(buffer, &e); err != nil || time.Now().After(e.Expires) {
+		os.Remove(file)
+		return BeaconResponse{}, false
+	}
+	return e.Response, true
+}
+
+
+// Store a response on disk, writing via a temporary file so readers never see partial entries
+func (d *diskCache) put(key string, response BeaconResponse, ttl time.Duration) {
+	buffer, err := json.Marshal(cacheEntry{time.Now().Add(ttl), response})
+	if err != nil {
+		return
+	}
+
+	tmp, err := ioutil.TempFile(d.dir, key + ".*.tmp")
+	if err != nil {
+		return
+	}
+
+	_, err = tmp.Write(buffer)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	os.Rename(tmp.Name(), filepath.Join(d.dir, key + ".json"))
+}
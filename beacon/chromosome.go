@@ -0,0 +1,149 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// Chromosome names: the aliases by which GRCh37 and GRCh38 chromosomes are
+// known, and the spelling each beacon expects
+
+import (
+	"fmt"
+	"strings"
+)
+
+
+// Styles of chromosome naming a beacon may expect
+const (
+	namingEnsembl = "ensembl"            // 13, X, MT (the default)
+	namingUCSC    = "ucsc"               // chr13, chrX, chrM
+	namingRefSeq  = "refseq"             // NC_000013.10, depending on assembly
+	namingGenBank = "genbank"            // CM000675.1, depending on assembly
+)
+
+var namingStyles = []string{namingEnsembl, namingUCSC, namingRefSeq, namingGenBank}
+
+
+// Chromosome, and the assembly if the name implies one
+type chromosomeAlias struct {
+	chromosome  string
+	assembly    string
+}
+
+// Chromosome names, in the order of their RefSeq and GenBank accession numbers
+var chromosomes = []string{
+	"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12",
+	"13", "14", "15", "16", "17", "18", "19", "20", "21", "22", "X", "Y",
+}
+
+// Version of each chromosome's RefSeq accession in each assembly
+var refseqVersions = map[string][]int{
+	"GRCh37": {10, 11, 11, 11, 9, 11, 13, 10, 11, 10, 9, 11, 10, 8, 9, 9, 10, 9, 9, 10, 8, 10, 10, 9},
+	"GRCh38": {11, 12, 12, 12, 10, 12, 14, 11, 12, 11, 10, 12, 11, 9, 10, 10, 11, 10, 10, 11, 9, 11, 11, 10},
+}
+
+// Version of the chromosomes' GenBank accessions in each assembly
+var genbankVersions = map[string]int{"GRCh37": 1, "GRCh38": 2}
+
+// Accessions of the mitochondrial sequence, which both assemblies share
+const (
+	mitochondrionRefSeq  = "NC_012920.1"
+	mitochondrionGenBank = "J01415.2"
+)
+
+// Map from upper-cased alias (e.g. CHR13, NC_000013.10) to chromosome
+var chromosomeAliases = map[string]chromosomeAlias{
+	"MT": {"MT", ""}, "M": {"MT", ""}, "CHRM": {"MT", ""}, "CHRMT": {"MT", ""},
+	mitochondrionRefSeq: {"MT", ""}, mitochondrionGenBank: {"MT", ""},
+}
+
+
+// Fill in alias table from chromosome and version lists
+func init() {
+	for _, chromosome := range chromosomes {
+		chromosomeAliases[chromosome] = chromosomeAlias{chromosome, ""}
+		chromosomeAliases["CHR" + chromosome] = chromosomeAlias{chromosome, ""}
+	}
+
+	for _, assembly := range assemblies {
+		for i, chromosome := range chromosomes {
+			chromosomeAliases[refseqAccession(i, assembly)] = chromosomeAlias{chromosome, assembly}
+			chromosomeAliases[genbankAccession(i, assembly)] = chromosomeAlias{chromosome, assembly}
+		}
+	}
+}
+
+
+// RefSeq accession of the i'th chromosome in an assembly
+func refseqAccession(i int, assembly string) string {
+	return fmt.Sprintf("NC_%06d.%d", i + 1, refseqVersions[assembly][i])
+}
+
+
+// GenBank accession of the i'th chromosome in an assembly
+func genbankAccession(i int, assembly string) string {
+	return fmt.Sprintf("CM%06d.%d", 663 + i, genbankVersions[assembly])
+}
+
+
+// Identify a chromosome by any of its aliases, along with the assembly if
+// the alias is an accession specific to one
+func lookupChromosome(name string) (chromosome string, assembly string, ok bool) {
+	alias, ok := chromosomeAliases[strings.ToUpper(name)]
+	return alias.chromosome, alias.assembly, ok
+}
+
+
+// Spell a chromosome in the given naming style. Names that aren't one of the
+// assembled chromosomes, and accessions where the assembly isn't known, are
+// left as they are.
+func chromosomeName(style string, chromosome string, assembly string) string {
+	i := -1
+	for j, c := range chromosomes {
+		if c == chromosome {
+			i = j
+		}
+	}
+	if i < 0 && chromosome != "MT" {
+		return chromosome
+	}
+
+	switch style {
+	case namingUCSC:
+		if chromosome == "MT" {
+			return "chrM"
+		}
+		return "chr" + chromosome
+
+	case namingRefSeq:
+		if chromosome == "MT" {
+			return mitochondrionRefSeq
+		}
+		if contains(assemblies, assembly) {
+			return refseqAccession(i, assembly)
+		}
+
+	case namingGenBank:
+		if chromosome == "MT" {
+			return mitochondrionGenBank
+		}
+		if contains(assemblies, assembly) {
+			return genbankAccession(i, assembly)
+		}
+	}
+
+	return chromosome
+}
@@ -0,0 +1,138 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// Credentials sent to beacons: the user's own tokens, tokens exchanged for
+// each beacon, an API key of the BoB's, or nothing
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+
+// What is sent to a beacon with a request
+type credentials struct {
+	accessToken  string                         // Sent as a bearer token
+	idToken      string                         // Sent in the IDToken header
+	apiKey       string                         // Sent in the beacon's API key header
+}
+
+
+// Ways of identifying the user to a beacon
+const (
+	credentialsForward  = "forward"             // The user's own access and ID tokens
+	credentialsExchange = "exchange"            // An access token exchanged for one for this beacon
+	credentialsAPIKey   = "apiKey"              // The BoB's API key; not the user at all
+	credentialsNone     = "none"
+)
+
+// Header in which API keys are sent, by default
+const defaultAPIKeyHeader = "X-API-Key"
+
+
+// Check and complete a beacon's choice of credentials. Beacons at plain HTTP
+// endpoints are sent none, unless they explicitly allow it.
+func configureCredentials(b *beaconStruct) error {
+	switch b.Credentials {
+	case "":
+		b.Credentials = credentialsForward
+	case credentialsForward, credentialsExchange, credentialsNone:
+	case credentialsAPIKey:
+		if b.APIKeyEnv != "" {
+			b.APIKey = os.Getenv(b.APIKeyEnv)
+		}
+		if b.APIKey == "" {
+			return errors.New("missing API key")
+		}
+		if b.APIKeyHeader == "" {
+			b.APIKeyHeader = defaultAPIKeyHeader
+		}
+	default:
+		return errors.New("unknown credentials " + b.Credentials)
+	}
+
+	if b.Credentials == credentialsExchange && b.Audience == "" {
+		b.Audience = beaconRoot(b.Endpoint)
+	}
+
+	if u, err := url.Parse(b.Endpoint); err == nil && u.Scheme != "https" && b.Credentials != credentialsNone && !b.AllowInsecure {
+		log.Print("not sending credentials to beacon ", b.Name, " at insecure endpoint ", b.Endpoint)
+		b.Credentials = credentialsNone
+	}
+
+	return nil
+}
+
+
+// Credentials to send a beacon on the principal's behalf. An anonymous
+// principal has no tokens, and so none are sent or exchanged.
+func beaconCredentials(ctx context.Context, b *beaconStruct, p *Principal) (*credentials, error) {
+	switch b.Credentials {
+	case credentialsForward:
+		return &credentials{accessToken: p.AccessToken, idToken: p.IDToken}, nil
+
+	case credentialsAPIKey:
+		return &credentials{apiKey: b.APIKey}, nil
+
+	case credentialsExchange:
+		if p.AccessToken == "" {
+			return nil, nil
+		}
+		if p.Exchange == nil {
+			return nil, errors.New("tokens can only be exchanged for a signed-in user")
+		}
+		token, err := p.Exchange(ctx, b.Audience, b.Scope)
+		if err != nil {
+			return nil, err
+		}
+		return &credentials{accessToken: token}, nil
+	}
+
+	return nil, nil
+}
+
+
+// Add credentials to a request to a beacon
+func (c *credentials) add(request *http.Request, b *beaconStruct) {
+	if c == nil {
+		return
+	}
+	if c.accessToken != "" {
+		request.Header.Set("Authorization", "Bearer " + c.accessToken)
+	}
+	if c.idToken != "" {
+		request.Header.Set("IDToken", c.idToken)
+	}
+	if c.apiKey != "" {
+		request.Header.Set(b.APIKeyHeader, c.apiKey)
+	}
+}
+
+
+// Whether a request carries credentials
+func hasCredentials(request *http.Request, b *beaconStruct) bool {
+	if request.Header.Get("Authorization") != "" || request.Header.Get("IDToken") != "" {
+		return true
+	}
+	return b.APIKeyHeader != "" && request.Header.Get(b.APIKeyHeader) != ""
+}
@@ -0,0 +1,231 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// Detection of a beacon's API version, and of its name, logo, datasets and
+// assemblies, from the information it publishes about itself
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+
+// What a beacon says about itself
+type beaconInfo struct {
+	version       string                 // API version, as registered in beaconType
+	root          string                 // Root of beacon's API
+	endpoint      string                 // URL to which queries for that version go
+	name          string
+	description   string
+	organization  string
+	logo          string                 // URL of beacon's logo
+	datasets      []interface{}          // Descriptions of datasets, as given
+	datasetIds    []string
+	assemblies    []string               // Standard names of assemblies of its datasets
+}
+
+
+// Time allowed for a beacon to describe itself
+const detectTimeout = 10 * time.Second
+
+// Paths, relative to a beacon's root, at which it may describe itself
+var infoPaths = []string{"", "/info", "/service-info"}
+
+// Query paths, which are trimmed from an endpoint to find the beacon's root
+var queryPaths = []string{"/query", "/g_variants"}
+
+// API versions as beacons report them, e.g. 0.3.0, v1.0.1 or v2.0.0
+var apiVersionPattern = regexp.MustCompile(`^v?(\d+)\.(\d+)`)
+
+
+// Work out a beacon's API version from the description of itself that it
+// publishes. The probe uses the beacon's configured timeouts and retries, but
+// no credentials.
+func detectBeacon(probe *beaconStruct) (*beaconInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), detectTimeout)
+	defer cancel()
+
+	info, err := fetchInfo(ctx, probe)
+	if err != nil {
+		return nil, err
+	}
+
+	// Versions before 2.0 take queries at /query, unless told otherwise
+	endpoint := strings.TrimSuffix(probe.Endpoint, "/")
+	info.endpoint = info.root
+	if info.version != "2.0" {
+		info.endpoint = probe.Endpoint
+		if info.root == endpoint {
+			info.endpoint = info.root + "/query"
+		}
+	}
+
+	return info, nil
+}
+
+
+// Fetch the description a beacon publishes of itself, from its root, /info or
+// /service-info, where the root is the endpoint less any query path such as
+// /query. Beacons of version 2.0 list their datasets separately.
+func fetchInfo(ctx context.Context, b *beaconStruct) (*beaconInfo, error) {
+	root := beaconRoot(b.Endpoint)
+
+	for _, p := range infoPaths {
+		status, body, err := httpFetch(ctx, b, root + p)
+		if err != nil || status / 100 != 2 {
+			continue
+		}
+
+		var doc interface{}
+		if json.Unmarshal(body, &doc) != nil {
+			continue
+		}
+
+		info := parseInfo(doc)
+		if info == nil {
+			continue
+		}
+		info.root = root
+
+		if info.version == "2.0" && len(info.datasets) == 0 {
+			if status, body, err := httpFetch(ctx, b, root + "/datasets"); err == nil && status / 100 == 2 {
+				if json.Unmarshal(body, &doc) == nil {
+					info.datasets = jsonPath(doc, "$.response.collections[*]")
+				}
+			}
+		}
+
+		for _, ds := range info.datasets {
+			if id, ok := jsonPathFirst(ds, "$.id").(string); ok && id != "" {
+				info.datasetIds = append(info.datasetIds, id)
+			}
+			for _, p := range []string{"$.assemblyId", "$.reference"} {
+				a, _ := jsonPathFirst(ds, p).(string)
+				if assembly, ok := canonicalAssembly(a); ok && !contains(info.assemblies, assembly) {
+					info.assemblies = append(info.assemblies, assembly)
+				}
+			}
+		}
+
+		return info, nil
+	}
+
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("%s did not describe itself within %v", b.Endpoint, detectTimeout)
+	}
+	return nil, fmt.Errorf("%s does not describe itself as a beacon of any known version", b.Endpoint)
+}
+
+
+// Root of a beacon's API: its endpoint, less any query path
+func beaconRoot(endpoint string) string {
+	root := strings.TrimSuffix(endpoint, "/")
+	for _, p := range queryPaths {
+		root = strings.TrimSuffix(root, p)
+	}
+	return root
+}
+
+
+// Interpret a beacon's description of itself. Version 2.0 wraps it in an
+// envelope with the version in meta; 1.0 and 0.3 give an apiVersion; 0.2 an
+// api; a GA4GH service-info gives the type of service and its version.
+func parseInfo(doc interface{}) *beaconInfo {
+	var version string
+	body := doc
+
+	switch {
+	case jsonPathFirst(doc, "$.meta.apiVersion") != nil:
+		version = fmt.Sprint(jsonPathFirst(doc, "$.meta.apiVersion"))
+		body = jsonPathFirst(doc, "$.response")
+	case jsonPathFirst(doc, "$.apiVersion") != nil:
+		version = fmt.Sprint(jsonPathFirst(doc, "$.apiVersion"))
+	case jsonPathFirst(doc, "$.api") != nil:
+		version = fmt.Sprint(jsonPathFirst(doc, "$.api"))
+	case jsonPathFirst(doc, "$.type.artifact") == "beacon":
+		version = fmt.Sprint(jsonPathFirst(doc, "$.type.version"))
+	default:
+		return nil
+	}
+
+	m := apiVersionPattern.FindStringSubmatch(version)
+	if m == nil {
+		return nil
+	}
+	info := &beaconInfo{version: m[1] + "." + m[2]}
+	if m[1] != "0" {
+		info.version = m[1] + ".0"
+	}
+	if _, ok := beaconType[info.version]; !ok {
+		return nil
+	}
+
+	info.name, _ = jsonPathFirst(body, "$.name").(string)
+	info.description, _ = jsonPathFirst(body, "$.description").(string)
+	info.organization, _ = jsonPathFirst(body, "$.organization.name").(string)
+
+	for _, p := range []string{"$.organization.logoUrl", "$.organization.logo"} {
+		if logo, ok := jsonPathFirst(body, p).(string); ok && (strings.HasPrefix(logo, "http://") || strings.HasPrefix(logo, "https://")) {
+			info.logo = logo
+			break
+		}
+	}
+
+	info.datasets = jsonPath(body, "$.datasets[*]")
+	return info
+}
+
+
+// Standard name of an assembly as a beacon may name it, e.g. hg19 or GRCh37.p13
+func canonicalAssembly(name string) (string, bool) {
+	name = strings.ToLower(strings.SplitN(name, ".", 2)[0])
+	assembly, ok := ucscAssemblies[name]
+	return assembly, ok
+}
+
+
+// Fill in what the configuration leaves out from what the beacon says about
+// itself. A logo is used as the beacon's icon.
+func (info *beaconInfo) apply(b *beaconStruct) {
+	b.Version = info.version
+	b.Endpoint = info.endpoint
+
+	if b.Name == "" {
+		b.Name = info.name
+	}
+	if b.Name == "" {
+		if u, err := url.Parse(info.endpoint); err == nil {
+			b.Name = u.Host
+		}
+	}
+	if b.Icon == "" {
+		b.Icon = info.logo
+	}
+	if b.DatasetIds == nil {
+		b.DatasetIds = info.datasetIds
+	}
+	if b.Assemblies == nil {
+		b.Assemblies = info.assemblies
+	}
+}
@@ -0,0 +1,182 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// Circuit breaker and background health tracking for beacons
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+
+// States of a circuit breaker
+const (
+	breakerClosed = "closed"                    // Beacon is queried as usual
+	breakerOpen   = "open"                      // Beacon is skipped until a probe succeeds
+)
+
+// Defaults for beacons whose configuration doesn't specify a policy
+const (
+	defaultFailureThreshold = 5                 // Consecutive failures before opening
+	defaultProbeInterval    = 30                // Seconds between probes of an open beacon
+)
+
+// Tracks the health of a single beacon
+type breaker struct {
+	mutex      sync.Mutex
+	state      string                           // Current state of the breaker
+	failures   int                              // Number of consecutive failures
+	since      time.Time                        // Time of the last change of state
+	lastError  string                           // Description of the most recent failure
+}
+
+// Health of a beacon, as reported to the UI and operators
+type BeaconHealth struct {
+	Name       string     `json:"name"`
+	State      string     `json:"state"`
+	Failures   int        `json:"consecutiveFailures"`
+	Since      time.Time  `json:"since"`
+	LastError  string     `json:"lastError,omitempty"`
+}
+
+
+// Create a closed circuit breaker
+func newBreaker() *breaker {
+	return &breaker{state: breakerClosed, since: time.Now()}
+}
+
+
+// Report the health of all configured beacons
+func Health() []BeaconHealth {
+	health := make([]BeaconHealth, 0, len(beacons))
+	for _, b := range beacons {
+		c := common(b)
+		c.health.mutex.Lock()
+		health = append(health, BeaconHealth{
+			Name: c.Name,
+			State: c.health.state,
+			Failures: c.health.failures,
+			Since: c.health.since,
+			LastError: c.health.lastError,
+		})
+		c.health.mutex.Unlock()
+	}
+	return health
+}
+
+
+// Report current state of the breaker
+func (b *breaker) current() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state
+}
+
+
+// Record the outcome of a request to the beacon, opening the breaker and
+// starting background probes after too many consecutive failures
+func (b *breaker) record(ctx context.Context, beacon *beaconStruct, status int, err error) {
+	// Requests abandoned by the caller say nothing about the beacon; those
+	// that ran out of time count against it
+	if ctx.Err() == context.Canceled {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err == nil && status/100 != 5 {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if err != nil {
+		b.lastError = err.Error()
+	} else {
+		b.lastError = fmt.Sprintf("HTTP status %d", status)
+	}
+
+	threshold := beacon.FailureThreshold
+	if threshold <= 0 {
+		threshold = defaultFailureThreshold
+	}
+
+	if b.state == breakerClosed && b.failures >= threshold {
+		b.state = breakerOpen
+		b.since = time.Now()
+		go b.probe(beacon)
+	}
+}
+
+
+// Periodically probe an unavailable beacon until it responds, then close the breaker
+func (b *breaker) probe(beacon *beaconStruct) {
+	interval := beacon.ProbeInterval
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+
+	for {
+		time.Sleep(seconds(interval))
+
+		if status, err := probeOnce(beacon); err == nil && status/100 != 5 {
+			b.mutex.Lock()
+			b.state = breakerClosed
+			b.failures = 0
+			b.since = time.Now()
+			b.mutex.Unlock()
+			return
+		} else if err != nil {
+			b.mutex.Lock()
+			b.lastError = err.Error()
+			b.mutex.Unlock()
+		}
+	}
+}
+
+
+// Send a request to the beacon's endpoint to see whether it is alive. No
+// tokens are sent; any reply other than a server error will do.
+func probeOnce(beacon *beaconStruct) (status int, err error) {
+	client := beacon.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), seconds(defaultProbeInterval))
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, "GET", beacon.Endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Add("Accept", "application/json")
+
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+
+	return response.StatusCode, nil
+}
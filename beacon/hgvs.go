@@ -0,0 +1,131 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// Parsing of HGVS genomic (g.) variant descriptions into beacon queries
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+
+// Patterns for HGVS genomic descriptions and their edits. Edits are matched
+// once upper-cased, so that bases may be written in either case.
+var (
+	hgvsPattern           = regexp.MustCompile(`^([A-Za-z0-9_.]+):g\.(\d+)(?:_(\d+))?(.*)$`)
+	hgvsSubstitution      = regexp.MustCompile(`^([ACGTN])>([ACGTN])$`)
+	hgvsDeletion          = regexp.MustCompile(`^DEL([ACGTN]*)$`)
+	hgvsDuplication       = regexp.MustCompile(`^DUP([ACGTN]*)$`)
+	hgvsInsertion         = regexp.MustCompile(`^INS([ACGTN]+)$`)
+	hgvsDeletionInsertion = regexp.MustCompile(`^DELINS([ACGTN]+)$`)
+)
+
+
+// Parse an HGVS genomic description, such as NC_000013.10:g.32900706A>T, into
+// a query. HGVS positions count from one; beacon positions from zero.
+// Substitutions and deletion-insertions are queried by their bases, while
+// deletions, duplications and insertions are queried by variant type, since
+// their flanking reference bases are not part of the description.
+func ParseHGVS(hgvs string) (*BeaconQuery, error) {
+	fail := func(message string) (*BeaconQuery, error) {
+		return nil, ValidationError{{"hgvs", message}}
+	}
+
+	m := hgvsPattern.FindStringSubmatch(strings.TrimSpace(hgvs))
+	if m == nil {
+		return fail("not a genomic (g.) HGVS description")
+	}
+
+	query := &BeaconQuery{}
+
+	// Identify the chromosome, and the assembly if the reference is an accession
+	if chromosome, assembly, ok := lookupChromosome(m[1]); ok {
+		query.ReferenceName, query.AssemblyId = chromosome, assembly
+	} else if strings.HasPrefix(strings.ToUpper(m[1]), "NC_") {
+		return fail("unknown RefSeq accession " + m[1])
+	} else {
+		query.ReferenceName = m[1]
+	}
+
+	first, _ := strconv.ParseInt(m[2], 10, 64)
+	last := first
+	if m[3] != "" {
+		last, _ = strconv.ParseInt(m[3], 10, 64)
+	}
+	if first < 1 || last < first {
+		return fail("invalid position range")
+	}
+
+	start := first - 1
+	end := last
+	edit := strings.ToUpper(m[4])
+
+	switch {
+	case hgvsSubstitution.MatchString(edit):
+		if first != last {
+			return fail("a substitution affects a single position")
+		}
+		s := hgvsSubstitution.FindStringSubmatch(edit)
+		query.Start = &start
+		query.ReferenceBases = s[1]
+		query.AlternateBases = s[2]
+
+	case hgvsDeletionInsertion.MatchString(edit):
+		s := hgvsDeletionInsertion.FindStringSubmatch(edit)
+		query.Start = &start
+		query.End = &end
+		query.ReferenceBases = "N"
+		query.AlternateBases = s[1]
+
+	case hgvsDeletion.MatchString(edit):
+		s := hgvsDeletion.FindStringSubmatch(edit)
+		if s[1] != "" && int64(len(s[1])) != last - first + 1 {
+			return fail("deleted sequence does not match the length of the range")
+		}
+		query.Start = &start
+		query.End = &end
+		query.ReferenceBases = s[1]
+		query.VariantType = "DEL"
+
+	case hgvsDuplication.MatchString(edit):
+		s := hgvsDuplication.FindStringSubmatch(edit)
+		if s[1] != "" && int64(len(s[1])) != last - first + 1 {
+			return fail("duplicated sequence does not match the length of the range")
+		}
+		query.Start = &start
+		query.End = &end
+		query.ReferenceBases = s[1]
+		query.VariantType = "DUP"
+
+	case hgvsInsertion.MatchString(edit):
+		if last != first + 1 {
+			return fail("an insertion must lie between two adjacent positions")
+		}
+		// Inserted between first and last: at zero-based position first
+		query.Start = &first
+		query.End = &first
+		query.VariantType = "INS"
+
+	default:
+		return fail("unsupported or malformed edit " + m[4])
+	}
+
+	return query, nil
+}
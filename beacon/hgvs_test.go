@@ -0,0 +1,93 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+import (
+	"strconv"
+	"testing"
+)
+
+
+// One case for each kind of edit, and for the malformed
+func TestParseHGVS(t *testing.T) {
+	position := func(n int64) *int64 { return &n }
+
+	tests := []struct {
+		hgvs   string
+		want   *BeaconQuery                    // nil if the description should be refused
+	}{
+		{"NC_000013.10:g.32900706A>T", &BeaconQuery{Start: position(32900705), ReferenceBases: "A", AlternateBases: "T"}},
+		{"NC_000013.10:g.32900706a>t", &BeaconQuery{Start: position(32900705), ReferenceBases: "A", AlternateBases: "T"}},
+		{"NC_000013.10:g.32900706del", &BeaconQuery{Start: position(32900705), End: position(32900706), VariantType: "DEL"}},
+		{"NC_000013.10:g.32900706_32900707delAG", &BeaconQuery{Start: position(32900705), End: position(32900707), ReferenceBases: "AG", VariantType: "DEL"}},
+		{"NC_000013.10:g.32900706dup", &BeaconQuery{Start: position(32900705), End: position(32900706), VariantType: "DUP"}},
+		{"NC_000013.10:g.32900706_32900707insAG", &BeaconQuery{Start: position(32900706), End: position(32900706), VariantType: "INS"}},
+		{"NC_000013.10:g.32900706_32900707delinsAG", &BeaconQuery{Start: position(32900705), End: position(32900707), ReferenceBases: "N", AlternateBases: "AG"}},
+		{"NC_000013.10:g.32900706_32900707DELINSag", &BeaconQuery{Start: position(32900705), End: position(32900707), ReferenceBases: "N", AlternateBases: "AG"}},
+		{"NC_000013.10:g.32900706_32900708insAG", nil},
+		{"NC_000013.10:g.32900706_32900707delA", nil},
+		{"NC_000013.10:g.32900706_32900707A>T", nil},
+		{"NC_000013.10:g.32900706inv", nil},
+	}
+
+	for _, test := range tests {
+		queries, err := ParseVariant(test.hgvs)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: accepted, want error", test.hgvs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.hgvs, err)
+			continue
+		}
+		if len(queries) != 1 {
+			t.Errorf("%s: %d queries, want 1", test.hgvs, len(queries))
+			continue
+		}
+
+		got := queries[0]
+		if got.ReferenceName != "13" || got.AssemblyId != "GRCh37" {
+			t.Errorf("%s: reference %s %s, want 13 GRCh37", test.hgvs, got.ReferenceName, got.AssemblyId)
+		}
+		if !samePosition(got.Start, test.want.Start) || !samePosition(got.End, test.want.End) {
+			t.Errorf("%s: start %s end %s, want start %s end %s", test.hgvs,
+				showPosition(got.Start), showPosition(got.End), showPosition(test.want.Start), showPosition(test.want.End))
+		}
+		if got.ReferenceBases != test.want.ReferenceBases || got.AlternateBases != test.want.AlternateBases || got.VariantType != test.want.VariantType {
+			t.Errorf("%s: %q>%q %q, want %q>%q %q", test.hgvs, got.ReferenceBases, got.AlternateBases, got.VariantType,
+				test.want.ReferenceBases, test.want.AlternateBases, test.want.VariantType)
+		}
+	}
+}
+
+
+// Whether two optional positions are the same
+func samePosition(a *int64, b *int64) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+
+// Show an optional position
+func showPosition(p *int64) string {
+	if p == nil {
+		return "none"
+	}
+	return strconv.FormatInt(*p, 10)
+}
@@ -0,0 +1,187 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// HTTP requests to beacons, shared by all versions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+
+// Status codes retried when the beacon's configuration doesn't say otherwise
+var defaultRetryStatus = []int{429, 502, 503, 504}
+
+
+// Create an HTTP client that applies the beacon's connect timeout; the read
+// timeout is applied to each request as a whole, by httpOnce. Requests
+// carrying credentials are not redirected to plain HTTP, unless the beacon
+// allows it.
+func newClient(beacon *beaconStruct) *http.Client {
+	dialer := &net.Dialer{Timeout: seconds(beacon.ConnectTimeout)}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: seconds(beacon.ConnectTimeout),
+	}
+	checkRedirect := func(request *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if request.URL.Scheme != "https" && !beacon.AllowInsecure && hasCredentials(request, beacon) {
+			return errors.New("refusing to send credentials to " + request.URL.Scheme + " URL " + request.URL.String())
+		}
+		return nil
+	}
+	return &http.Client{Transport: transport, CheckRedirect: checkRedirect}
+}
+
+
+// Convert a (possibly fractional) number of seconds to a duration
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+
+// Wrapper for HTTP get
+func httpGet(ctx context.Context, beacon *beaconStruct, uri string, creds *credentials) (status int, body []byte, attempts int, err error) {
+	return httpDo(ctx, beacon, "GET", uri, nil, creds)
+}
+
+
+// Wrapper for HTTP post of a JSON document
+func httpPost(ctx context.Context, beacon *beaconStruct, uri string, document interface{}, creds *credentials) (status int, body []byte, attempts int, err error) {
+	var js []byte
+	if js, err = json.Marshal(document); err != nil {
+		return
+	}
+	return httpDo(ctx, beacon, "POST", uri, js, creds)
+}
+
+
+// Fetch a document from a beacon, such as its info, without counting the
+// outcome toward the beacon's health, which reflects only its answers to
+// queries
+func httpFetch(ctx context.Context, beacon *beaconStruct, uri string) (status int, body []byte, err error) {
+	status, body, _, err = httpRetry(ctx, beacon, "GET", uri, nil, nil)
+	return
+}
+
+
+// Perform a query's HTTP request. Only the final outcome, after any retries,
+// counts toward the beacon's health.
+func httpDo(ctx context.Context, beacon *beaconStruct, method string, uri string, payload []byte, creds *credentials) (status int, body []byte, attempts int, err error) {
+	status, body, attempts, err = httpRetry(ctx, beacon, method, uri, payload, creds)
+	if beacon.health != nil {
+		beacon.health.record(ctx, beacon, status, err)
+	}
+	return
+}
+
+
+// Perform an HTTP request, retrying with exponential backoff according to the
+// beacon's policy. Gives up, without further retries, if ctx is cancelled.
+func httpRetry(ctx context.Context, beacon *beaconStruct, method string, uri string, payload []byte, creds *credentials) (status int, body []byte, attempts int, err error) {
+	wait := seconds(beacon.Backoff)
+
+	for attempts = 1; ; attempts++ {
+		status, body, err = httpOnce(ctx, beacon, method, uri, payload, creds)
+
+		if attempts > beacon.MaxRetries || ctx.Err() != nil || !retryable(beacon, status, err) {
+			return
+		}
+
+		select {
+		case <- time.After(wait):
+			wait *= 2
+		case <- ctx.Done():
+			return
+		}
+	}
+}
+
+
+// Perform a single HTTP request, passing along the credentials, if any. The
+// beacon's read timeout limits the whole exchange, up to the end of the body.
+func httpOnce(ctx context.Context, beacon *beaconStruct, method string, uri string, payload []byte, creds *credentials) (status int, body []byte, err error) {
+	client := beacon.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if beacon.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, seconds(beacon.ReadTimeout))
+		defer cancel()
+	}
+
+	var reader io.Reader
+	if payload != nil {
+		reader = bytes.NewReader(payload)
+	}
+
+	var request *http.Request
+	if request, err = http.NewRequestWithContext(ctx, method, uri, reader); err == nil {
+		request.Header.Add("Accept", "application/json")
+		if payload != nil {
+			request.Header.Add("Content-Type", "application/json")
+		}
+		creds.add(request, beacon)
+	} else {
+		return
+	}
+
+	var response *http.Response
+	if response, err = client.Do(request); err == nil {
+		defer response.Body.Close()
+	} else {
+		return
+	}
+
+	body, err = ioutil.ReadAll(response.Body)
+	status = response.StatusCode
+	return
+}
+
+
+// Decide whether a failed request is worth retrying
+func retryable(beacon *beaconStruct, status int, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	retry := beacon.RetryStatus
+	if retry == nil {
+		retry = defaultRetryStatus
+	}
+
+	for _, s := range retry {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
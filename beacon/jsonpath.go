@@ -0,0 +1,138 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// A small subset of JSONPath, for picking results out of beacon replies
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+
+// Step of a path: a member name or array index, possibly followed by indexes
+var jsonPathStep = regexp.MustCompile(`^([^\[\]]*)((?:\[(?:\d+|\*)\])*)$`)
+var jsonPathIndex = regexp.MustCompile(`\[(\d+|\*)\]`)
+
+
+// Check that a path is one we can follow: $ followed by steps such as .name,
+// .name[0], .name[*] or .*
+func checkJSONPath(path string) error {
+	if path != "$" && !strings.HasPrefix(path, "$.") && !strings.HasPrefix(path, "$[") {
+		return fmt.Errorf("JSONPath %s must start with $", path)
+	}
+	for _, step := range jsonPathSteps(path) {
+		if !jsonPathStep.MatchString(step) {
+			return fmt.Errorf("unsupported JSONPath step %s in %s", step, path)
+		}
+	}
+	return nil
+}
+
+
+// Steps of a path, after the $
+func jsonPathSteps(path string) []string {
+	rest := strings.TrimPrefix(path, "$")
+	if rest == "" {
+		return nil
+	}
+	if strings.HasPrefix(rest, "[") {
+		rest = "." + rest
+	}
+	return strings.Split(strings.TrimPrefix(rest, "."), ".")
+}
+
+
+// Find all the values in a decoded JSON document matching a path. Wildcards
+// ([*] and .*) may match many values; a path that leads nowhere matches none.
+func jsonPath(doc interface{}, path string) []interface{} {
+	values := []interface{}{doc}
+
+	for _, step := range jsonPathSteps(path) {
+		m := jsonPathStep.FindStringSubmatch(step)
+		if m == nil {
+			return nil
+		}
+
+		next := make([]interface{}, 0, len(values))
+		for _, v := range values {
+			switch {
+			case m[1] == "":
+				next = append(next, v)
+			case m[1] == "*":
+				next = append(next, children(v)...)
+			default:
+				if obj, ok := v.(map[string]interface{}); ok {
+					if child, found := obj[m[1]]; found {
+						next = append(next, child)
+					}
+				}
+			}
+		}
+
+		for _, index := range jsonPathIndex.FindAllStringSubmatch(m[2], -1) {
+			indexed := make([]interface{}, 0, len(next))
+			for _, v := range next {
+				list, ok := v.([]interface{})
+				if !ok {
+					continue
+				}
+				if index[1] == "*" {
+					indexed = append(indexed, list...)
+				} else if i, _ := strconv.Atoi(index[1]); i < len(list) {
+					indexed = append(indexed, list[i])
+				}
+			}
+			next = indexed
+		}
+
+		values = next
+	}
+
+	return values
+}
+
+
+// The first value matching a path, or nil if there is none
+func jsonPathFirst(doc interface{}, path string) interface{} {
+	if path == "" {
+		return nil
+	}
+	if values := jsonPath(doc, path); len(values) > 0 {
+		return values[0]
+	}
+	return nil
+}
+
+
+// Members of an object or elements of an array
+func children(v interface{}) []interface{} {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		values := make([]interface{}, 0, len(c))
+		for _, child := range c {
+			values = append(values, child)
+		}
+		return values
+	case []interface{}:
+		return c
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// Liftover of query coordinates between assemblies, using UCSC chain files
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+
+// Ungapped block of alignment between two assemblies
+type chainBlock struct {
+	start       int64                // Start in source chromosome, zero-based
+	end         int64                // End in source chromosome, exclusive
+	chromosome  string               // Destination chromosome
+	offset      int64                // Start in destination, on its own strand
+	size        int64                // Size of destination chromosome
+	reverse     bool                 // Whether destination is the reverse strand
+}
+
+// Blocks for each source chromosome, ordered by start
+type liftover map[string][]chainBlock
+
+// Source and destination assemblies
+type assemblyPair struct {
+	from  string
+	to    string
+}
+
+
+// Liftovers that have been loaded, by source and destination assembly
+var liftovers = make(map[assemblyPair]liftover)
+
+// Chain file names, e.g. hg19ToHg38.over.chain.gz
+var chainFilePattern = regexp.MustCompile(`^([A-Za-z0-9]+)To([A-Za-z0-9]+)\.over\.chain(\.gz)?$`)
+
+// Assemblies by their UCSC names, as used in chain file names
+var ucscAssemblies = map[string]string{
+	"hg19": "GRCh37", "grch37": "GRCh37",
+	"hg38": "GRCh38", "grch38": "GRCh38",
+}
+
+
+// Load every UCSC chain file in a directory, such as hg19ToHg38.over.chain.gz,
+// for lifting queries between the assemblies it names. A missing directory
+// simply means no liftover.
+func LoadChains(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		m := chainFilePattern.FindStringSubmatch(file.Name())
+		if m == nil {
+			continue
+		}
+
+		from, to := ucscAssemblies[strings.ToLower(m[1])], ucscAssemblies[strings.ToLower(m[2])]
+		if from == "" || to == "" {
+			return fmt.Errorf("chain file %s: unknown assembly", file.Name())
+		}
+
+		l, err := readChainFile(filepath.Join(dir, file.Name()), m[3] != "")
+		if err != nil {
+			return fmt.Errorf("chain file %s: %v", file.Name(), err)
+		}
+		liftovers[assemblyPair{from, to}] = l
+	}
+
+	return nil
+}
+
+
+// Read a chain file, which may be compressed
+func readChainFile(file string, compressed bool) (liftover, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if compressed {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	return parseChains(r)
+}
+
+
+// Parse chains: each a header line, followed by lines giving the size of an
+// ungapped block and the gaps in source and destination that follow it
+func parseChains(r io.Reader) (liftover, error) {
+	l := make(liftover)
+	var header chainBlock
+	var source string
+	var t, q int64
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		numbers := make([]int64, len(fields))
+		for i, f := range fields {
+			numbers[i], _ = strconv.ParseInt(f, 10, 64)
+		}
+
+		switch {
+		case len(fields) == 0:
+			continue
+
+		case fields[0] == "chain" && len(fields) >= 12:
+			// chain score tName tSize tStrand tStart tEnd qName qSize qStrand qStart qEnd [id]
+			source = canonicalChromosome(fields[2])
+			header = chainBlock{chromosome: canonicalChromosome(fields[7]), size: numbers[8], reverse: fields[9] == "-"}
+			t, q = numbers[5], numbers[10]
+
+		case source != "" && (len(fields) == 3 || len(fields) == 1):
+			block := header
+			block.start, block.end, block.offset = t, t + numbers[0], q
+			l[source] = append(l[source], block)
+			if len(fields) == 3 {
+				t, q = block.end + numbers[1], q + numbers[0] + numbers[2]
+			}
+
+		default:
+			return nil, fmt.Errorf("malformed line %d", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, blocks := range l {
+		sort.Slice(blocks, func(i, j int) bool { return blocks[i].start < blocks[j].start })
+	}
+	return l, nil
+}
+
+
+// Standard name of a chromosome named in a chain file, if it has one
+func canonicalChromosome(name string) string {
+	if chromosome, _, ok := lookupChromosome(name); ok {
+		return chromosome
+	}
+	return name
+}
+
+
+// Lift a single position, reporting whether it lands on the reverse strand
+func (l liftover) position(chromosome string, pos int64) (string, int64, bool, bool) {
+	blocks := l[chromosome]
+	i := sort.Search(len(blocks), func(i int) bool { return blocks[i].end > pos })
+	if i == len(blocks) || blocks[i].start > pos {
+		return "", 0, false, false
+	}
+
+	b := blocks[i]
+	lifted := b.offset + pos - b.start
+	if b.reverse {
+		lifted = b.size - lifted - 1
+	}
+	return b.chromosome, lifted, b.reverse, true
+}
+
+
+// Translate a query to another assembly. Positions that have no counterpart
+// in the other assembly, and variants whose bases would be split by a gap in
+// the alignment, cannot be lifted.
+func liftQuery(query *BeaconQuery, to string) (*BeaconQuery, error) {
+	l, ok := liftovers[assemblyPair{query.AssemblyId, to}]
+	if !ok {
+		return nil, fmt.Errorf("no liftover from %s to %s", query.AssemblyId, to)
+	}
+
+	lifted := *query
+	lifted.AssemblyId = to
+
+	missing := func(pos int64) error {
+		return fmt.Errorf("%s:%d has no counterpart in %s", query.ReferenceName, pos, to)
+	}
+
+	// Lift the first and last positions of the variant, along with the chromosome
+	liftInterval := func(first int64, last int64) (int64, int64, bool, error) {
+		c1, p1, r1, ok1 := l.position(query.ReferenceName, first)
+		if !ok1 {
+			return 0, 0, false, missing(first)
+		}
+		c2, p2, r2, ok2 := l.position(query.ReferenceName, last)
+		if !ok2 {
+			return 0, 0, false, missing(last)
+		}
+		if c1 != c2 || r1 != r2 {
+			return 0, 0, false, fmt.Errorf("%s:%d-%d is split in %s", query.ReferenceName, first, last, to)
+		}
+		lifted.ReferenceName = c1
+		if r1 {
+			p1, p2 = p2, p1
+		}
+		return p1, p2, r1, nil
+	}
+
+	if query.Start != nil {
+		first, last := *query.Start, *query.Start
+		if query.End != nil && *query.End > first {
+			last = *query.End - 1
+		} else if n := int64(len(query.ReferenceBases)); n > 1 {
+			last = first + n - 1
+		}
+
+		start, end, reverse, err := liftInterval(first, last)
+		if err != nil {
+			return nil, err
+		}
+		if query.End == nil && end - start != last - first {
+			return nil, fmt.Errorf("%s:%d-%d spans a gap in the alignment with %s", query.ReferenceName, first, last, to)
+		}
+
+		lifted.Start = &start
+		if query.End != nil {
+			end := end + 1
+			if *query.End <= *query.Start {
+				// An insertion point: between bases, whichever strand
+				if reverse {
+					start++
+				}
+				end = start
+				lifted.Start = &start
+			}
+			lifted.End = &end
+		}
+
+		if reverse {
+			lifted.ReferenceBases = reverseComplement(query.ReferenceBases)
+			lifted.AlternateBases = reverseComplement(query.AlternateBases)
+			if err := reanchor(&lifted); err != nil {
+				return nil, err
+			}
+		}
+		return &lifted, nil
+	}
+
+	// Imprecise bounds; these are not lifted onto the reverse strand, where
+	// starts and ends would change places
+	chromosome := ""
+	bounds := []**int64{&lifted.StartMin, &lifted.StartMax, &lifted.EndMin, &lifted.EndMax}
+	for _, bound := range bounds {
+		if *bound == nil {
+			continue
+		}
+		pos, _, reverse, err := liftInterval(**bound, **bound)
+		if err != nil {
+			return nil, err
+		}
+		if reverse {
+			return nil, fmt.Errorf("%s:%d lies on the reverse strand in %s", query.ReferenceName, **bound, to)
+		}
+		if chromosome != "" && lifted.ReferenceName != chromosome {
+			return nil, fmt.Errorf("bounds on %s are split in %s", query.ReferenceName, to)
+		}
+		chromosome = lifted.ReferenceName
+		*bound = &pos
+	}
+
+	return &lifted, nil
+}
+
+
+// Move the padding base of an indel lifted onto the reverse strand back to its
+// left. Indels in VCF form share their first base, which, once complemented,
+// is their last; the base before the indel, which takes its place, is read
+// from the reference sequence of the assembly lifted to.
+func reanchor(query *BeaconQuery) error {
+	refBases, altBases := query.ReferenceBases, query.AlternateBases
+	if len(refBases) == len(altBases) || len(refBases) == 0 || len(altBases) == 0 ||
+		refBases[len(refBases) - 1] != altBases[len(altBases) - 1] {
+		return nil
+	}
+
+	ref, ok := references[query.AssemblyId]
+	if !ok {
+		return fmt.Errorf("indels on the reverse strand in %s cannot be lifted without its reference sequence", query.AssemblyId)
+	}
+	start := *query.Start - 1
+	base, err := ref.bases(query.ReferenceName, start, start + 1)
+	if err != nil {
+		return err
+	}
+
+	query.Start = &start
+	query.ReferenceBases = base + refBases[:len(refBases) - 1]
+	query.AlternateBases = base + altBases[:len(altBases) - 1]
+	if query.End != nil {
+		end := *query.End - 1
+		query.End = &end
+	}
+	return nil
+}
+
+
+// Reverse complement of a sequence of bases
+func reverseComplement(bases string) string {
+	complement := map[byte]byte{'A': 'T', 'C': 'G', 'G': 'C', 'T': 'A', 'N': 'N'}
+	rc := make([]byte, len(bases))
+	for i := 0; i < len(bases); i++ {
+		rc[len(bases) - i - 1] = complement[bases[i]]
+	}
+	return string(rc)
+}
@@ -0,0 +1,77 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+
+// An indel lifted onto the reverse strand keeps its padding base on the left
+func TestLiftReverseIndel(t *testing.T) {
+	// Chromosome 13 of 1000 bases, aligned end to end with the reverse strand
+	chains, err := parseChains(strings.NewReader("chain 1 chr13 1000 + 0 1000 chr13 1000 - 0 1000 1\n1000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair := assemblyPair{"GRCh37", "GRCh38"}
+	liftovers[pair] = chains
+	defer delete(liftovers, pair)
+
+	// Deletion of G after A at 101 (one-based), i.e. 899-900 on the other strand
+	start := int64(100)
+	query := &BeaconQuery{ReferenceName: "13", Start: &start, ReferenceBases: "AG", AlternateBases: "A", AssemblyId: "GRCh37"}
+
+	if _, err := liftQuery(query, "GRCh38"); err == nil {
+		t.Error("lifted without the reference sequence, want error")
+	}
+
+	// The GRCh38 reference has C and T where the deletion lands, after A
+	sequence := []byte(strings.Repeat("G", 1000))
+	sequence[897], sequence[898], sequence[899] = 'A', 'C', 'T'
+	dir, err := ioutil.TempDir("", "liftover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fasta := filepath.Join(dir, "GRCh38.fa")
+	ioutil.WriteFile(fasta, []byte(">13\n" + string(sequence) + "\n"), 0600)
+	ioutil.WriteFile(fasta + ".fai", []byte("13\t1000\t4\t1000\t1001\n"), 0600)
+	if err := LoadReference("GRCh38", fasta); err != nil {
+		t.Fatal(err)
+	}
+	defer delete(references, "GRCh38")
+
+	lifted, err := liftQuery(query, "GRCh38")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *lifted.Start != 897 || lifted.ReferenceBases != "AC" || lifted.AlternateBases != "A" {
+		t.Errorf("lifted to %d %s>%s, want 897 AC>A", *lifted.Start, lifted.ReferenceBases, lifted.AlternateBases)
+	}
+
+	// Substitutions need no anchor
+	query.ReferenceBases, query.AlternateBases = "A", "T"
+	if lifted, err := liftQuery(query, "GRCh38"); err != nil || *lifted.Start != 899 || lifted.ReferenceBases != "T" || lifted.AlternateBases != "A" {
+		t.Errorf("substitution lifted to %v, %v; want 899 T>A", lifted, err)
+	}
+}
@@ -0,0 +1,241 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// Metadata describing the beacons and their datasets, fetched from the
+// beacons periodically and kept for annotating their responses
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+
+// Description of an upstream dataset, as its beacon gives it
+type DatasetInfo struct {
+	Id                 string       `json:"id"`
+	Name               string       `json:"name,omitempty"`
+	Description        string       `json:"description,omitempty"`
+	AssemblyId         string       `json:"assemblyId,omitempty"`
+	VariantCount       int64        `json:"variantCount,omitempty"`
+	CallCount          int64        `json:"callCount,omitempty"`
+	SampleCount        int64        `json:"sampleCount,omitempty"`
+	Version            string       `json:"version,omitempty"`
+	ExternalURL        string       `json:"externalUrl,omitempty"`
+	Updated            string       `json:"updateDateTime,omitempty"`
+	DataUseConditions  interface{}  `json:"dataUseConditions,omitempty"`
+}
+
+// Description of a configured beacon and its datasets
+type BeaconDescription struct {
+	Name          string         `json:"name"`
+	Version       string         `json:"version"`
+	Icon          string         `json:"icon,omitempty"`
+	Description   string         `json:"description,omitempty"`
+	Organization  string         `json:"organization,omitempty"`
+	Assemblies    []string       `json:"assemblies,omitempty"`
+	Health        string         `json:"health"`
+	Datasets      []DatasetInfo  `json:"datasets"`
+	Fetched       *time.Time     `json:"fetched,omitempty"`     // When metadata was last fetched
+	Error         string         `json:"error,omitempty"`       // Why the last fetch failed
+}
+
+// Metadata last fetched from a beacon
+type metadataCache struct {
+	mutex         sync.RWMutex
+	description   string
+	organization  string
+	datasets      []DatasetInfo
+	fetched       time.Time
+	lastError     string
+}
+
+
+// Paths at which the versions give each detail of a dataset; 0.2 differs
+var datasetPaths = map[string][]string{
+	"name":              {"$.name"},
+	"description":       {"$.description"},
+	"assemblyId":        {"$.assemblyId", "$.reference"},
+	"variantCount":      {"$.variantCount", "$.size.variants"},
+	"callCount":         {"$.callCount"},
+	"sampleCount":       {"$.sampleCount", "$.size.samples"},
+	"version":           {"$.version"},
+	"externalUrl":       {"$.externalUrl", "$.externalURL"},
+	"updated":           {"$.updateDateTime"},
+	"dataUseConditions": {"$.dataUseConditions", "$.data_use"},
+}
+
+
+// Fetch metadata from each beacon now, and then every interval seconds.
+// Beacons of the custom version, which describe themselves in no standard
+// way, are not asked.
+func StartMetadataRefresh(interval int) {
+	if interval <= 0 {
+		return
+	}
+
+	for _, b := range beacons {
+		c := common(b)
+		if c.Version == "custom" {
+			continue
+		}
+
+		go func(c *beaconStruct) {
+			for {
+				c.metadata.refresh(c)
+				time.Sleep(time.Duration(interval) * time.Second)
+			}
+		}(c)
+	}
+}
+
+
+// Describe all configured beacons and their datasets
+func Beacons() []BeaconDescription {
+	descriptions := make([]BeaconDescription, 0, len(beacons))
+	for _, b := range beacons {
+		c := common(b)
+		d := BeaconDescription{
+			Name: c.Name,
+			Version: c.Version,
+			Icon: c.Icon,
+			Assemblies: c.Assemblies,
+			Health: c.health.current(),
+			Datasets: make([]DatasetInfo, 0),
+		}
+
+		c.metadata.mutex.RLock()
+		d.Description, d.Organization, d.Error = c.metadata.description, c.metadata.organization, c.metadata.lastError
+		if !c.metadata.fetched.IsZero() {
+			fetched := c.metadata.fetched
+			d.Fetched = &fetched
+		}
+		d.Datasets = append(d.Datasets, c.metadata.datasets...)
+		c.metadata.mutex.RUnlock()
+
+		// Before metadata arrives, or without it, list the configured datasets
+		if len(d.Datasets) == 0 {
+			for _, id := range c.DatasetIds {
+				d.Datasets = append(d.Datasets, DatasetInfo{Id: id})
+			}
+		}
+
+		descriptions = append(descriptions, d)
+	}
+	return descriptions
+}
+
+
+// Fetch a beacon's metadata, keeping what was fetched before if it fails.
+// Only the datasets the beacon is configured to query are kept.
+func (m *metadataCache) refresh(b *beaconStruct) {
+	ctx, cancel := context.WithTimeout(context.Background(), detectTimeout)
+	defer cancel()
+
+	info, err := fetchInfo(ctx, b)
+	if err != nil {
+		log.Print("unable to fetch metadata for beacon ", b.Name, ": ", err)
+		m.mutex.Lock()
+		m.lastError = err.Error()
+		m.mutex.Unlock()
+		return
+	}
+
+	datasets := make([]DatasetInfo, 0, len(info.datasets))
+	for _, ds := range info.datasets {
+		d := parseDatasetInfo(ds)
+		if d.Id != "" && (len(b.DatasetIds) == 0 || contains(b.DatasetIds, d.Id)) {
+			datasets = append(datasets, d)
+		}
+	}
+
+	m.mutex.Lock()
+	m.description, m.organization, m.datasets = info.description, info.organization, datasets
+	m.fetched, m.lastError = time.Now(), ""
+	m.mutex.Unlock()
+}
+
+
+// Metadata for the datasets reported in a response. A single result reported
+// under the beacon's own name is described by the beacon's only dataset.
+func (m *metadataCache) forResponse(name string, response *BeaconResponse) map[string]DatasetInfo {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	found := make(map[string]DatasetInfo)
+	for key := range response.Results {
+		if key == name && len(m.datasets) == 1 {
+			found[key] = m.datasets[0]
+			continue
+		}
+		for _, d := range m.datasets {
+			if d.Id == key {
+				found[key] = d
+			}
+		}
+	}
+
+	if len(found) == 0 {
+		return nil
+	}
+	return found
+}
+
+
+// Interpret a dataset's description, in whichever version's form
+func parseDatasetInfo(ds interface{}) DatasetInfo {
+	first := func(detail string) interface{} {
+		for _, p := range datasetPaths[detail] {
+			if v := jsonPathFirst(ds, p); v != nil {
+				return v
+			}
+		}
+		return nil
+	}
+	text := func(detail string) string {
+		s, _ := first(detail).(string)
+		return s
+	}
+	count := func(detail string) int64 {
+		n, _ := numberValue(first(detail))
+		return int64(n)
+	}
+
+	d := DatasetInfo{
+		Name: text("name"),
+		Description: text("description"),
+		VariantCount: count("variantCount"),
+		CallCount: count("callCount"),
+		SampleCount: count("sampleCount"),
+		Version: text("version"),
+		ExternalURL: text("externalUrl"),
+		Updated: text("updated"),
+		DataUseConditions: first("dataUseConditions"),
+	}
+	d.Id, _ = jsonPathFirst(ds, "$.id").(string)
+
+	if assembly, ok := canonicalAssembly(text("assemblyId")); ok {
+		d.AssemblyId = assembly
+	} else {
+		d.AssemblyId = text("assemblyId")
+	}
+
+	return d
+}
@@ -0,0 +1,258 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// Parsing of variants written in the various notations users paste in:
+// HGVS, VCF data lines, SPDI, and BoB's own shorthand
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+
+// Patterns for the notations
+var (
+	spdiPattern      = regexp.MustCompile(`^([A-Za-z0-9_.]+):(\d+):([ACGTN]*|\d+):([ACGTN]*)$`)
+	accessionPattern = regexp.MustCompile(`^[A-Z]{2}_\d+(?:\.\d+)?:`)
+	regionPattern    = regexp.MustCompile(`^([A-Za-z0-9_.]+):(\d+)-(\d+)(?:\s+([A-Za-z]+))?$`)
+	bracketPattern   = regexp.MustCompile(`^([A-Za-z0-9_.]+):(\d+)\.\.(\d+)(?:-(\d+)\.\.(\d+))?(?:\s+([A-Za-z]+))?$`)
+	shorthandPattern = regexp.MustCompile(`^([A-Za-z0-9_.]+)[:\s]+(\d+)(?:[:\s]+([ACGTNacgtn]*)(?:\s*>\s*|[:\s]+)([ACGTNacgtn]+))?$`)
+	symbolicPattern  = regexp.MustCompile(`^<([A-Z]+)(?::[^>]*)?>$`)
+	endInfoPattern   = regexp.MustCompile(`(?:^|;)END=(\d+)(?:;|$)`)
+)
+
+
+// Parse a variant written in any of the supported notations, recognizing the
+// notation from the text. Most notations describe a single variant, but a
+// VCF line with several alternate alleles yields one query per allele. Only
+// text naming its sequence by accession is taken as SPDI; with a chromosome
+// name, as in 13:32900706:A:T, it is shorthand, and counts from one.
+//
+//   HGVS        NC_000013.10:g.32900706A>T     (positions count from one)
+//   VCF         13  32900706  .  A  T,C        (positions count from one)
+//   SPDI        NC_000013.10:32900705:A:T      (positions count from zero)
+//   Shorthand   13:32900706 A>T                (positions count from one)
+//               13:32900706:A:T
+//               13 32900706 A T
+//               13:32906408-32907524 DEL
+//               13:32906000..32906500-32907000..32907600 DUP
+func ParseVariant(text string) ([]BeaconQuery, error) {
+	text = strings.TrimSpace(text)
+
+	switch {
+	case strings.Contains(text, ":g."):
+		query, err := ParseHGVS(text)
+		if err != nil {
+			return nil, err
+		}
+		return []BeaconQuery{*query}, nil
+
+	case len(strings.Fields(text)) >= 5:
+		return ParseVCF(text)
+
+	case spdiPattern.MatchString(strings.ToUpper(text)) && accessionPattern.MatchString(strings.ToUpper(text)):
+		query, err := ParseSPDI(text)
+		if err != nil {
+			return nil, err
+		}
+		return []BeaconQuery{*query}, nil
+
+	default:
+		query, err := parseShorthand(text)
+		if err != nil {
+			return nil, err
+		}
+		return []BeaconQuery{*query}, nil
+	}
+}
+
+
+// Parse a VCF data line (CHROM POS ID REF ALT ...), giving one query for
+// each alternate allele. Symbolic alleles such as <DEL> are queried by
+// variant type, using the END given in the INFO column, if any.
+func ParseVCF(line string) ([]BeaconQuery, error) {
+	fail := func(message string) ([]BeaconQuery, error) {
+		return nil, ValidationError{{"vcf", message}}
+	}
+
+	// Data lines are tab-separated, but pasted ones may have lost their tabs
+	fields := strings.Split(strings.TrimSpace(line), "\t")
+	if len(fields) < 5 {
+		fields = strings.Fields(line)
+	}
+	if len(fields) < 5 {
+		return fail("a VCF data line needs at least CHROM, POS, ID, REF and ALT columns")
+	}
+
+	pos, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || pos < 1 {
+		return fail("POS must be a positive integer")
+	}
+	start := pos - 1
+
+	ref := strings.ToUpper(fields[3])
+	info := ""
+	if len(fields) >= 8 {
+		info = fields[7]
+	}
+
+	queries := make([]BeaconQuery, 0)
+	for _, alt := range strings.Split(fields[4], ",") {
+		query := BeaconQuery{ReferenceName: fields[0], Start: &start, ReferenceBases: ref}
+
+		switch {
+		case alt == "." || alt == "*":
+			// No alternate allele, or an overlapping deletion: nothing to query
+			continue
+
+		case symbolicPattern.MatchString(alt):
+			query.VariantType = symbolicPattern.FindStringSubmatch(alt)[1]
+			if m := endInfoPattern.FindStringSubmatch(info); m != nil {
+				end, _ := strconv.ParseInt(m[1], 10, 64)
+				query.End = &end
+			}
+
+		default:
+			query.AlternateBases = strings.ToUpper(alt)
+		}
+
+		queries = append(queries, query)
+	}
+
+	if len(queries) == 0 {
+		return fail("ALT contains no alleles to query")
+	}
+	return queries, nil
+}
+
+
+// Parse an NCBI SPDI expression (sequence:position:deletion:insertion). The
+// deletion may be given as a sequence or as a length; the position counts
+// from zero, as beacon positions do.
+func ParseSPDI(spdi string) (*BeaconQuery, error) {
+	fail := func(message string) (*BeaconQuery, error) {
+		return nil, ValidationError{{"spdi", message}}
+	}
+
+	m := spdiPattern.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(spdi)))
+	if m == nil {
+		return fail("not an SPDI expression")
+	}
+
+	query := &BeaconQuery{}
+	if chromosome, assembly, ok := lookupChromosome(m[1]); ok {
+		query.ReferenceName, query.AssemblyId = chromosome, assembly
+	} else if strings.HasPrefix(m[1], "NC_") {
+		return fail("unknown RefSeq accession " + m[1])
+	} else {
+		query.ReferenceName = m[1]
+	}
+
+	start, _ := strconv.ParseInt(m[2], 10, 64)
+	query.Start = &start
+
+	deleted, inserted := m[3], m[4]
+	length := int64(len(deleted))
+	if n, err := strconv.ParseInt(deleted, 10, 64); err == nil {
+		length, deleted = n, ""
+	}
+	end := start + length
+
+	switch {
+	case length == 0 && inserted == "":
+		return fail("describes no change")
+
+	case length == 0:
+		query.End = &start
+		query.VariantType = "INS"
+
+	case inserted == "":
+		query.End = &end
+		query.ReferenceBases = deleted
+		query.VariantType = "DEL"
+
+	default:
+		if deleted == "" {
+			deleted = "N"
+		}
+		if length != 1 || int64(len(inserted)) != 1 {
+			query.End = &end
+		}
+		query.ReferenceBases = deleted
+		query.AlternateBases = inserted
+	}
+
+	return query, nil
+}
+
+
+// Parse BoB's own shorthand: a position with optional bases, a region with
+// optional structural variant type, or imprecise bounds. As in HGVS and VCF,
+// positions count from one, and regions include both ends; they are turned
+// into beacon positions, which count from zero and exclude the end.
+func parseShorthand(text string) (*BeaconQuery, error) {
+	valid := true
+	number := func(s string, offset int64) *int64 {
+		if s == "" {
+			return nil
+		}
+		n, _ := strconv.ParseInt(s, 10, 64)
+		if n < 1 {
+			valid = false
+		}
+		n -= offset
+		return &n
+	}
+	position := func(s string) *int64 { return number(s, 1) }
+	end := func(s string) *int64 { return number(s, 0) }
+
+	var query *BeaconQuery
+	if m := regionPattern.FindStringSubmatch(text); m != nil {
+		query = &BeaconQuery{
+			ReferenceName: m[1],
+			Start: position(m[2]),
+			End: end(m[3]),
+			VariantType: strings.ToUpper(m[4]),
+		}
+	} else if m := bracketPattern.FindStringSubmatch(text); m != nil {
+		query = &BeaconQuery{
+			ReferenceName: m[1],
+			StartMin: position(m[2]),
+			StartMax: position(m[3]),
+			EndMin: end(m[4]),
+			EndMax: end(m[5]),
+			VariantType: strings.ToUpper(m[6]),
+		}
+	} else if m := shorthandPattern.FindStringSubmatch(text); m != nil {
+		query = &BeaconQuery{
+			ReferenceName: m[1],
+			Start: position(m[2]),
+			ReferenceBases: strings.ToUpper(m[3]),
+			AlternateBases: strings.ToUpper(m[4]),
+		}
+	} else {
+		return nil, ValidationError{{"variant", "not recognized as HGVS, VCF, SPDI or chromosome:position notation"}}
+	}
+
+	if !valid {
+		return nil, ValidationError{{"variant", "positions count from one"}}
+	}
+	return query, nil
+}
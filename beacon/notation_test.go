@@ -0,0 +1,81 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+import (
+	"testing"
+)
+
+
+
+// Shorthand positions count from one, as VCF's and HGVS's do
+func TestParseShorthand(t *testing.T) {
+	position := func(n int64) *int64 { return &n }
+
+	tests := []struct {
+		text   string
+		want   *BeaconQuery                     // nil if the text should be refused
+	}{
+		{"13 32900706 A T", &BeaconQuery{Start: position(32900705), ReferenceBases: "A", AlternateBases: "T"}},
+		{"13:32900706 a>t", &BeaconQuery{Start: position(32900705), ReferenceBases: "A", AlternateBases: "T"}},
+		{"13:32900706", &BeaconQuery{Start: position(32900705)}},
+		{"13:32906408-32907524 del", &BeaconQuery{Start: position(32906407), End: position(32907524), VariantType: "DEL"}},
+		{"13:32906000..32906500-32907000..32907600 DUP", &BeaconQuery{StartMin: position(32905999), StartMax: position(32906499),
+			EndMin: position(32907000), EndMax: position(32907600), VariantType: "DUP"}},
+		{"13:0 A>T", nil},
+		{"13:0-100", nil},
+	}
+
+	for _, test := range tests {
+		queries, err := ParseVariant(test.text)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: accepted, want error", test.text)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.text, err)
+			continue
+		}
+
+		got := queries[0]
+		if !samePosition(got.Start, test.want.Start) || !samePosition(got.End, test.want.End) ||
+			!samePosition(got.StartMin, test.want.StartMin) || !samePosition(got.StartMax, test.want.StartMax) ||
+			!samePosition(got.EndMin, test.want.EndMin) || !samePosition(got.EndMax, test.want.EndMax) {
+			t.Errorf("%s: start %s end %s, bounds %s..%s-%s..%s", test.text, showPosition(got.Start), showPosition(got.End),
+				showPosition(got.StartMin), showPosition(got.StartMax), showPosition(got.EndMin), showPosition(got.EndMax))
+		}
+		if got.ReferenceBases != test.want.ReferenceBases || got.AlternateBases != test.want.AlternateBases || got.VariantType != test.want.VariantType {
+			t.Errorf("%s: %q>%q %q, want %q>%q %q", test.text, got.ReferenceBases, got.AlternateBases, got.VariantType,
+				test.want.ReferenceBases, test.want.AlternateBases, test.want.VariantType)
+		}
+	}
+
+	// The VCF line and every spelling of the shorthand for a variant are the
+	// same query; only accessions make SPDI, which counts from zero
+	vcf, _ := ParseVariant("13 32900706 . A T")
+	for _, text := range []string{"13 32900706 A T", "13:32900706 A>T", "13:32900706:A:T", "NC_000013.10:32900705:A:T"} {
+		queries, err := ParseVariant(text)
+		if err != nil {
+			t.Errorf("%s: %v", text, err)
+		} else if !samePosition(vcf[0].Start, queries[0].Start) {
+			t.Errorf("%s: start %s, want %s as in VCF", text, showPosition(queries[0].Start), showPosition(vcf[0].Start))
+		}
+	}
+}
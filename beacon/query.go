@@ -0,0 +1,463 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// Structured, validated beacon queries
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+
+// A query to be posed to each of the beacons
+type BeaconQuery struct {
+	ReferenceName   string    `json:"referenceName"`
+	Start           *int64    `json:"start,omitempty"`
+	End             *int64    `json:"end,omitempty"`
+	StartMin        *int64    `json:"startMin,omitempty"`
+	StartMax        *int64    `json:"startMax,omitempty"`
+	EndMin          *int64    `json:"endMin,omitempty"`
+	EndMax          *int64    `json:"endMax,omitempty"`
+	ReferenceBases  string    `json:"referenceBases,omitempty"`
+	AlternateBases  string    `json:"alternateBases,omitempty"`
+	AssemblyId      string    `json:"assemblyId,omitempty"`
+	VariantType     string    `json:"variantType,omitempty"`
+	DatasetIds      []string  `json:"datasetIds,omitempty"`
+}
+
+// Problem with a single field of a query
+type FieldError struct {
+	Field    string  `json:"field"`
+	Message  string  `json:"message"`
+}
+
+// All of the problems found with a query
+type ValidationError []FieldError
+
+// Standard name and value of a query parameter
+type queryParam struct {
+	name   string
+	value  interface{}
+}
+
+
+// Assemblies that may be named in a query
+var assemblies = []string{"GRCh37", "GRCh38"}
+
+// Variant types that may be named in a query
+var variantTypes = []string{"DEL", "DUP", "INS", "INV", "CNV", "BND"}
+
+// Patterns for checking field contents
+var (
+	referenceNamePattern = regexp.MustCompile(`^[0-9A-Za-z_.]+$`)
+	basesPattern         = regexp.MustCompile(`^[ACGTN]+$`)
+)
+
+
+// Describe all problems with the query
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, f := range e {
+		msgs[i] = fmt.Sprintf("%s: %s", f.Field, f.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+
+// Decode a query from JSON, rejecting unknown fields, and validate it. The
+// variant may be given by the query's own fields, as an HGVS genomic
+// description in an "hgvs" field, or in any notation understood by
+// ParseVariant in a "variant" field. A variant with several alternate
+// alleles yields one query per allele. A batch may be given instead, as a
+// list of queries in a "queries" field, or as the lines of a VCF file in a
+// "vcf" field; the batch's assemblyId and datasetIds apply to any of its
+// queries that don't give their own.
+func ParseQueries(data []byte) ([]BeaconQuery, error) {
+	return parseQueries(data, BeaconQuery{}, true)
+}
+
+
+// Decode and validate a query, or if allowed a batch, starting from defaults
+func parseQueries(data []byte, defaults BeaconQuery, batch bool) ([]BeaconQuery, error) {
+	var input struct {
+		BeaconQuery
+		HGVS     string             `json:"hgvs,omitempty"`
+		Variant  string             `json:"variant,omitempty"`
+		VCF      string             `json:"vcf,omitempty"`
+		Queries  []json.RawMessage  `json:"queries,omitempty"`
+	}
+	input.BeaconQuery = defaults
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&input); err != nil {
+		if te, ok := err.(*json.UnmarshalTypeError); ok {
+			return nil, ValidationError{{te.Field, "must be of type " + te.Type.String()}}
+		}
+		if strings.HasPrefix(err.Error(), "json: unknown field ") {
+			field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+			return nil, ValidationError{{field, "unknown field"}}
+		}
+		return nil, ValidationError{{"query", "malformed query"}}
+	}
+
+	forms := 0
+	for _, given := range []bool{input.HGVS != "", input.Variant != "", input.VCF != "", input.Queries != nil} {
+		if given {
+			forms++
+		}
+	}
+	if forms > 1 {
+		return nil, ValidationError{{"query", "only one of hgvs, variant, vcf and queries may be given"}}
+	}
+	if !batch && (input.VCF != "" || input.Queries != nil) {
+		return nil, ValidationError{{"query", "a batch cannot contain another batch"}}
+	}
+
+	queries := []BeaconQuery{input.BeaconQuery}
+	var err error
+
+	switch {
+	case input.VCF != "":
+		return ParseBatchVCF(input.VCF, input.BeaconQuery)
+	case input.Queries != nil:
+		return parseBatch(input.Queries, input.BeaconQuery)
+	case input.HGVS != "":
+		var query *BeaconQuery
+		if query, err = input.BeaconQuery.WithHGVS(input.HGVS); err != nil {
+			return nil, err
+		}
+		queries = []BeaconQuery{*query}
+	case input.Variant != "":
+		if queries, err = input.BeaconQuery.WithVariant(input.Variant); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range queries {
+		if err := queries[i].Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return queries, nil
+}
+
+
+// Describe the query's variant by an HGVS genomic description
+func (query BeaconQuery) WithHGVS(hgvs string) (*BeaconQuery, error) {
+	parsed, err := ParseHGVS(hgvs)
+	if err != nil {
+		return nil, err
+	}
+
+	merged, err := mergeParsed(query, "hgvs", []BeaconQuery{*parsed})
+	if err != nil {
+		return nil, err
+	}
+	return &merged[0], nil
+}
+
+
+// Describe the query's variant in any notation understood by ParseVariant,
+// giving one query per alternate allele
+func (query BeaconQuery) WithVariant(text string) ([]BeaconQuery, error) {
+	parsed, err := ParseVariant(text)
+	if err != nil {
+		return nil, err
+	}
+	return mergeParsed(query, "variant", parsed)
+}
+
+
+// Combine variants parsed from some other notation with those fields of the
+// query that the notation doesn't describe: the datasets, and the assembly,
+// if the notation doesn't imply one
+func mergeParsed(query BeaconQuery, field string, parsed []BeaconQuery) ([]BeaconQuery, error) {
+	if describesVariant(&query) {
+		return nil, ValidationError{{field, "cannot be combined with other fields describing the variant"}}
+	}
+
+	for i := range parsed {
+		if parsed[i].AssemblyId == "" {
+			parsed[i].AssemblyId = query.AssemblyId
+		} else if query.AssemblyId != "" && query.AssemblyId != parsed[i].AssemblyId {
+			return nil, ValidationError{{"assemblyId", "conflicts with assembly " + parsed[i].AssemblyId + " implied by " + field}}
+		}
+		parsed[i].DatasetIds = query.DatasetIds
+	}
+
+	return parsed, nil
+}
+
+
+// Report whether any of the fields describing the variant are given
+func describesVariant(query *BeaconQuery) bool {
+	return query.ReferenceName != "" || query.Start != nil || query.End != nil ||
+		query.StartMin != nil || query.StartMax != nil || query.EndMin != nil || query.EndMax != nil ||
+		query.ReferenceBases != "" || query.AlternateBases != "" || query.VariantType != ""
+}
+
+
+// Check each field of the query, returning all problems found. A query that
+// passes is checked against the reference sequence for its assembly, if one
+// has been loaded, and its indel (if any) put into standard form.
+func (query *BeaconQuery) Validate() error {
+	var errs ValidationError
+
+	// Normalize case of fields that are case-insensitive
+	query.ReferenceBases = strings.ToUpper(query.ReferenceBases)
+	query.AlternateBases = strings.ToUpper(query.AlternateBases)
+	query.VariantType = strings.ToUpper(query.VariantType)
+
+	// Use the standard name for any known chromosome; accessions imply an assembly
+	if chromosome, assembly, ok := lookupChromosome(query.ReferenceName); ok {
+		query.ReferenceName = chromosome
+		if query.AssemblyId == "" {
+			query.AssemblyId = assembly
+		} else if assembly != "" && assembly != query.AssemblyId {
+			errs = append(errs, FieldError{"assemblyId", "conflicts with assembly " + assembly + " implied by referenceName"})
+		}
+	}
+
+	if query.ReferenceName == "" {
+		errs = append(errs, FieldError{"referenceName", "is required"})
+	} else if !referenceNamePattern.MatchString(query.ReferenceName) {
+		errs = append(errs, FieldError{"referenceName", "is not a valid reference name"})
+	}
+
+	errs = append(errs, query.validatePositions()...)
+
+	if query.ReferenceBases != "" && !basesPattern.MatchString(query.ReferenceBases) {
+		errs = append(errs, FieldError{"referenceBases", "must contain only A, C, G, T or N"})
+	}
+
+	if query.AlternateBases != "" && !basesPattern.MatchString(query.AlternateBases) {
+		errs = append(errs, FieldError{"alternateBases", "must contain only A, C, G, T or N"})
+	}
+
+	if query.ReferenceBases != "" && query.ReferenceBases == query.AlternateBases {
+		errs = append(errs, FieldError{"alternateBases", "is the same as referenceBases, and so describes no change"})
+	}
+
+	if query.AssemblyId != "" && !contains(assemblies, query.AssemblyId) {
+		errs = append(errs, FieldError{"assemblyId", "must be one of " + strings.Join(assemblies, ", ")})
+	}
+
+	if query.VariantType != "" && !contains(variantTypes, query.VariantType) {
+		errs = append(errs, FieldError{"variantType", "must be one of " + strings.Join(variantTypes, ", ")})
+	}
+
+	// Structural variants are described by type, not by their bases
+	if query.VariantType != "" && query.AlternateBases != "" {
+		errs = append(errs, FieldError{"variantType", "cannot be combined with alternateBases"})
+	}
+
+	for _, d := range query.DatasetIds {
+		if strings.TrimSpace(d) == "" {
+			errs = append(errs, FieldError{"datasetIds", "must not contain empty dataset IDs"})
+			break
+		}
+	}
+
+	// Check the bases against the reference sequence, and normalize indels
+	if len(errs) == 0 {
+		errs = query.normalize()
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+
+// Check the positions: either a start (with optional end) or a range of starts
+// (with optional range of ends), consistently ordered and not negative
+func (query *BeaconQuery) validatePositions() ValidationError {
+	var errs ValidationError
+
+	positions := []struct {
+		field  string
+		value  *int64
+	}{
+		{"start", query.Start}, {"end", query.End},
+		{"startMin", query.StartMin}, {"startMax", query.StartMax},
+		{"endMin", query.EndMin}, {"endMax", query.EndMax},
+	}
+	for _, p := range positions {
+		if p.value != nil && *p.value < 0 {
+			errs = append(errs, FieldError{p.field, "must not be negative"})
+		}
+	}
+
+	bracket := query.StartMin != nil || query.StartMax != nil || query.EndMin != nil || query.EndMax != nil
+
+	switch {
+	case query.Start != nil && bracket:
+		errs = append(errs, FieldError{"start", "cannot be combined with startMin, startMax, endMin or endMax"})
+
+	case query.Start != nil:
+		if query.End != nil && *query.End < *query.Start {
+			errs = append(errs, FieldError{"end", "must not be before start"})
+		}
+
+	case bracket:
+		if query.End != nil {
+			errs = append(errs, FieldError{"end", "cannot be combined with startMin, startMax, endMin or endMax"})
+		}
+		if query.StartMin == nil || query.StartMax == nil {
+			errs = append(errs, FieldError{"startMin", "startMin and startMax must be given together"})
+		} else if *query.StartMax < *query.StartMin {
+			errs = append(errs, FieldError{"startMax", "must not be before startMin"})
+		}
+		if (query.EndMin == nil) != (query.EndMax == nil) {
+			errs = append(errs, FieldError{"endMin", "endMin and endMax must be given together"})
+		} else if query.EndMin != nil && *query.EndMax < *query.EndMin {
+			errs = append(errs, FieldError{"endMax", "must not be before endMin"})
+		}
+
+	default:
+		errs = append(errs, FieldError{"start", "is required"})
+	}
+
+	return errs
+}
+
+
+// List the parameters present in the query, by standard name, in a stable order
+func (query *BeaconQuery) params() []queryParam {
+	ps := make([]queryParam, 0, 8)
+
+	add := func(name string, value string) {
+		if value != "" {
+			ps = append(ps, queryParam{name, value})
+		}
+	}
+
+	addPosition := func(name string, value *int64) {
+		if value != nil {
+			ps = append(ps, queryParam{name, *value})
+		}
+	}
+
+	add("chromosome", query.ReferenceName)
+	addPosition("start", query.Start)
+	addPosition("end", query.End)
+	addPosition("startMin", query.StartMin)
+	addPosition("startMax", query.StartMax)
+	addPosition("endMin", query.EndMin)
+	addPosition("endMax", query.EndMax)
+	add("referenceBases", query.ReferenceBases)
+	add("alternateBases", query.AlternateBases)
+	add("variantType", query.VariantType)
+	add("assemblyId", query.AssemblyId)
+
+	return ps
+}
+
+
+// Kinds of query that need particular parameters, for explaining why a beacon can't answer
+var queryKinds = map[string]string{
+	"end":         "region queries",
+	"startMin":    "range queries",
+	"startMax":    "range queries",
+	"endMin":      "range queries",
+	"endMax":      "range queries",
+	"variantType": "structural variant queries",
+}
+
+
+// List the kinds of query, or failing that the parameters, that the beacon
+// has no way to express
+func unsupportedParams(beacon *beaconStruct, query *BeaconQuery) []string {
+	unsupported := make([]string, 0)
+	for _, p := range query.params() {
+		if name, ok := beacon.QueryMap[p.name]; !ok || name == "" {
+			kind, known := queryKinds[p.name]
+			if !known {
+				kind = p.name
+			}
+			if !contains(unsupported, kind) {
+				unsupported = append(unsupported, kind)
+			}
+		}
+	}
+	return unsupported
+}
+
+
+// Map a standard parameter onto the beacon's own name and vocabulary
+func mapParam(beacon *beaconStruct, p queryParam) (name string, value interface{}, ok bool) {
+	if name, ok = beacon.QueryMap[p.name]; !ok || name == "" {
+		return "", nil, false
+	}
+
+	value = p.value
+	if p.name == "assemblyId" {
+		if v, found := beacon.QueryMap[p.value.(string)]; found {
+			value = v
+		}
+	}
+
+	return name, value, true
+}
+
+
+// Datasets to query at a beacon: those configured, restricted to those
+// requested. A beacon whose datasets aren't known is asked for those
+// requested. If datasets were requested but the beacon has none of them,
+// the list is empty, and the beacon must not be queried at all.
+func queryDatasets(beacon *beaconStruct, query *BeaconQuery) []string {
+	if len(query.DatasetIds) == 0 {
+		return beacon.DatasetIds
+	}
+	if len(beacon.DatasetIds) == 0 {
+		return query.DatasetIds
+	}
+
+	datasets := make([]string, 0, len(beacon.DatasetIds))
+	for _, d := range beacon.DatasetIds {
+		if contains(query.DatasetIds, d) {
+			datasets = append(datasets, d)
+		}
+	}
+	return datasets
+}
+
+
+// Whether the query asks only for datasets the beacon doesn't have
+func noDatasetsAt(beacon *beaconStruct, query *BeaconQuery) bool {
+	return len(query.DatasetIds) > 0 && len(queryDatasets(beacon, query)) == 0
+}
+
+
+// Report whether a list of strings contains a given string
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// Reference sequences, read from indexed FASTA files, for checking and
+// normalizing the variants in queries
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+
+// Entry in a FASTA index (.fai) for a single sequence
+type faiEntry struct {
+	length     int64                 // Number of bases in sequence
+	offset     int64                 // Byte offset of first base in file
+	lineBases  int64                 // Bases on each line
+	lineBytes  int64                 // Bytes in each line, including newline
+}
+
+// Indexed FASTA file for an assembly
+type referenceSequence struct {
+	file   *os.File
+	index  map[string]faiEntry       // By standard chromosome name
+}
+
+
+// Reference sequences that have been loaded, by assembly
+var references = make(map[string]*referenceSequence)
+
+// Indels are shifted left at most this many bases; those in longer repeats
+// are left as they are
+const maxNormalizeShift = 10000
+
+// Bases of the reference read at a time while shifting an indel
+const normalizeChunk = 256
+
+
+// Use an indexed FASTA file (with its .fai index alongside) as the reference
+// sequence for an assembly. Queries for that assembly have their bases checked
+// against the reference, and their indels left-aligned and trimmed.
+func LoadReference(assembly string, file string) error {
+	if !contains(assemblies, assembly) {
+		return fmt.Errorf("unknown assembly %s", assembly)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+
+	index, err := readFastaIndex(file + ".fai")
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	references[assembly] = &referenceSequence{f, index}
+	return nil
+}
+
+
+// Read a FASTA index: name, length, offset, bases per line, bytes per line
+func readFastaIndex(file string) (map[string]faiEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	index := make(map[string]faiEntry)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("%s: malformed line %d", file, line)
+		}
+
+		var numbers [4]int64
+		for i := range numbers {
+			if numbers[i], err = strconv.ParseInt(fields[i + 1], 10, 64); err != nil {
+				return nil, fmt.Errorf("%s: malformed line %d", file, line)
+			}
+		}
+
+		// Sequence names may be followed by a description
+		name := canonicalChromosome(strings.Fields(fields[0])[0])
+		index[name] = faiEntry{numbers[0], numbers[1], numbers[2], numbers[3]}
+	}
+
+	return index, scanner.Err()
+}
+
+
+// Read the bases from start to end (zero-based, exclusive) of a chromosome
+func (ref *referenceSequence) bases(chromosome string, start int64, end int64) (string, error) {
+	entry, ok := ref.index[chromosome]
+	if !ok || start < 0 || end > entry.length || end < start {
+		return "", fmt.Errorf("%s:%d-%d is not in the reference sequence", chromosome, start, end)
+	}
+
+	byteOffset := func(pos int64) int64 {
+		return entry.offset + pos / entry.lineBases * entry.lineBytes + pos % entry.lineBases
+	}
+
+	first, last := byteOffset(start), byteOffset(end)
+	buffer := make([]byte, last - first)
+	if _, err := ref.file.ReadAt(buffer, first); err != nil {
+		return "", err
+	}
+
+	buffer = bytes.Replace(buffer, []byte("\n"), nil, -1)
+	buffer = bytes.Replace(buffer, []byte("\r"), nil, -1)
+	return strings.ToUpper(string(buffer)), nil
+}
+
+
+// Check the query's reference bases against the reference sequence, and put
+// an indel into its standard form: trimmed of bases common to reference and
+// alternate, and shifted as far left as it will go. Queries for assemblies or
+// chromosomes without a reference sequence are left as they are.
+func (query *BeaconQuery) normalize() ValidationError {
+	ref, ok := references[query.AssemblyId]
+	if !ok || query.Start == nil || query.ReferenceBases == "" {
+		return nil
+	}
+
+	entry, found := ref.index[query.ReferenceName]
+	if !found {
+		return nil
+	}
+
+	start := *query.Start
+	end := start + int64(len(query.ReferenceBases))
+	if end > entry.length {
+		return ValidationError{{"start", fmt.Sprintf("%s:%d-%d is beyond the end of the chromosome in %s",
+			query.ReferenceName, start, end, query.AssemblyId)}}
+	}
+
+	actual, err := ref.bases(query.ReferenceName, start, end)
+	if err != nil {
+		log.Print("unable to read reference sequence: ", err)
+		return nil
+	}
+
+	// N stands for any base, as when only the length of the reference is known
+	for i := 0; i < len(actual); i++ {
+		if query.ReferenceBases[i] != 'N' && query.ReferenceBases[i] != actual[i] {
+			return ValidationError{{"referenceBases", fmt.Sprintf("%s does not match the %s reference, which has %s at %s:%d",
+				query.ReferenceBases, query.AssemblyId, actual, query.ReferenceName, start)}}
+		}
+	}
+
+	// Only precisely described indels are normalized
+	if query.End != nil || query.AlternateBases == "" || strings.ContainsRune(query.ReferenceBases + query.AlternateBases, 'N') {
+		return nil
+	}
+
+	// The reference preceding start is read in chunks, as the indel is shifted
+	refBases, altBases := query.ReferenceBases, query.AlternateBases
+	preceding, shifted := "", int64(0)
+	for {
+		// Trim a common last base; if either allele is left empty, extend both to the left
+		if len(refBases) > 0 && len(altBases) > 0 && refBases[len(refBases) - 1] == altBases[len(altBases) - 1] {
+			refBases, altBases = refBases[:len(refBases) - 1], altBases[:len(altBases) - 1]
+		} else if len(refBases) > 0 && len(altBases) > 0 {
+			break
+		}
+
+		if len(refBases) == 0 || len(altBases) == 0 {
+			if start == 0 || shifted >= maxNormalizeShift {
+				return nil
+			}
+			if preceding == "" {
+				from := start - normalizeChunk
+				if from < 0 {
+					from = 0
+				}
+				if preceding, err = ref.bases(query.ReferenceName, from, start); err != nil {
+					log.Print("unable to read reference sequence: ", err)
+					return nil
+				}
+			}
+			base := preceding[len(preceding) - 1:]
+			preceding = preceding[:len(preceding) - 1]
+			refBases, altBases, start, shifted = base + refBases, base + altBases, start - 1, shifted + 1
+		}
+	}
+
+	// Trim common first bases, keeping at least one base in each allele
+	for len(refBases) > 1 && len(altBases) > 1 && refBases[0] == altBases[0] {
+		refBases, altBases, start = refBases[1:], altBases[1:], start + 1
+	}
+
+	query.Start = &start
+	query.ReferenceBases, query.AlternateBases = refBases, altBases
+	return nil
+}
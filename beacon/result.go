@@ -0,0 +1,277 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package beacon
+
+// Per-dataset results, and defensive interpretation of the replies in which
+// beacons give them
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+
+// Version of the schema of BeaconResponse, as sent to clients. Version 1 gave
+// each dataset's result as a string; version 2 gives a DatasetResult.
+const ResponseSchemaVersion = 2
+
+
+// Result from a single dataset
+type DatasetResult struct {
+	Exists        *bool          `json:"exists"`                   // nil if unknown
+	Error         string         `json:"error,omitempty"`          // Why the dataset couldn't answer
+	SetType       string         `json:"setType,omitempty"`
+	Frequency     *float64       `json:"frequency,omitempty"`
+	VariantCount  *int64         `json:"variantCount,omitempty"`
+	CallCount     *int64         `json:"callCount,omitempty"`
+	SampleCount   *int64         `json:"sampleCount,omitempty"`
+	Note          string         `json:"note,omitempty"`
+	ExternalURL   string         `json:"externalUrl,omitempty"`
+	Info          interface{}    `json:"info,omitempty"`
+	Handovers     []Handover     `json:"handovers,omitempty"`
+	Missing       []Requirement  `json:"missing,omitempty"`        // What user lacks, if not authorized
+}
+
+// Link to further information held by a beacon, such as the variant's
+// record in a dataset
+type Handover struct {
+	Type  string  `json:"type,omitempty"`
+	Note  string  `json:"note,omitempty"`
+	URL   string  `json:"url"`
+}
+
+
+// Create an empty response from a beacon
+func newResponse(b *beaconStruct) *BeaconResponse {
+	return &BeaconResponse{Name: b.Name,
+		Icon: b.Icon,
+		SchemaVersion: ResponseSchemaVersion,
+		Results: make(map[string]DatasetResult),
+		Error: make(map[string]string)}
+}
+
+
+// Copy a response's results, so that results can be added to a response
+// that is shared, e.g. with the cache
+func copyResults(results map[string]DatasetResult) map[string]DatasetResult {
+	copied := make(map[string]DatasetResult, len(results))
+	for k, v := range results {
+		copied[k] = v
+	}
+	return copied
+}
+
+
+// Interpret a reply in the form of versions 0.3 and 1.0: an overall exists,
+// or results for each dataset in datasetAlleleResponses, or an error
+func parseAlleleResponse(response *BeaconResponse, status int, raw []byte) {
+	var doc interface{}
+
+	// Errors may be described in the body of a non-2xx reply
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		if status/100 != 2 {
+			addResponseError(response, status, "beacon error")
+		} else {
+			addResponseError(response, 400, "malformed reply from beacon")
+		}
+		return
+	}
+
+	if code, message, ok := parseError(jsonPathFirst(doc, "$.error")); ok {
+		if code == 0 {
+			code = status
+		}
+		addResponseError(response, code, message)
+		return
+	}
+
+	if status/100 != 2 {
+		addResponseError(response, status, "beacon error")
+		return
+	}
+
+	response.Status = status
+	response.Handovers = parseHandovers(jsonPathFirst(doc, "$.beaconHandover"))
+
+	// Without dataset responses, report the overall result under the beacon's name
+	datasets := jsonPath(doc, "$.datasetAlleleResponses[*]")
+	if len(datasets) == 0 {
+		addResponseResult(response, response.Name, DatasetResult{Exists: existsValue(jsonPathFirst(doc, "$.exists"))})
+		return
+	}
+
+	for _, ds := range datasets {
+		id := stringValue(jsonPathFirst(ds, "$.datasetId"))
+		if id == "" {
+			continue
+		}
+
+		result := DatasetResult{
+			Exists: existsValue(jsonPathFirst(ds, "$.exists")),
+			Note: stringValue(jsonPathFirst(ds, "$.note")),
+			ExternalURL: stringValue(jsonPathFirst(ds, "$.externalUrl")),
+			Info: jsonPathFirst(ds, "$.info"),
+			Handovers: parseHandovers(jsonPathFirst(ds, "$.datasetHandover")),
+		}
+		fillCounts(&result, ds, "$.variantCount", "$.callCount", "$.sampleCount", "$.frequency")
+
+		if _, message, ok := parseError(jsonPathFirst(ds, "$.error")); ok {
+			result.Exists, result.Error = nil, message
+		}
+
+		addResponseResult(response, id, result)
+	}
+}
+
+
+// Fill in a result's counts and frequency from the values at the given paths,
+// ignoring any that aren't numbers
+func fillCounts(result *DatasetResult, doc interface{}, variantCount string, callCount string, sampleCount string, frequency string) {
+	count := func(path string) *int64 {
+		if n, ok := numberValue(jsonPathFirst(doc, path)); ok {
+			i := int64(n)
+			return &i
+		}
+		return nil
+	}
+
+	result.VariantCount = count(variantCount)
+	result.CallCount = count(callCount)
+	result.SampleCount = count(sampleCount)
+	if f, ok := numberValue(jsonPathFirst(doc, frequency)); ok {
+		result.Frequency = &f
+	}
+}
+
+
+// Interpret an error object, whose code may be a number or a string, and
+// whose message may be called errorMessage or message. A bare string is
+// taken as the message, a bare number as the code, and true as an error
+// with neither; false, zero, empty strings and empty objects are no error.
+func parseError(v interface{}) (int, string, bool) {
+	switch e := v.(type) {
+	case string:
+		return 0, e, e != ""
+
+	case bool:
+		return 0, "beacon error", e
+
+	case float64:
+		return int(e), "beacon error", e != 0
+
+	case map[string]interface{}:
+		code := 0
+		if n, ok := numberValue(e["errorCode"]); ok {
+			code = int(n)
+		}
+
+		message := stringValue(e["errorMessage"])
+		if message == "" {
+			message = stringValue(e["message"])
+		}
+		if message == "" && code == 0 {
+			return 0, "", false
+		}
+		if message == "" {
+			message = "beacon error"
+		}
+		return code, message, true
+	}
+
+	return 0, "", false
+}
+
+
+// Interpret a handover, or a list of them; those without a URL are dropped
+func parseHandovers(v interface{}) []Handover {
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+
+	var handovers []Handover
+	for _, h := range list {
+		handover := Handover{
+			Type: stringValue(jsonPathFirst(h, "$.handoverType.label")),
+			Note: stringValue(jsonPathFirst(h, "$.note")),
+			URL: stringValue(jsonPathFirst(h, "$.url")),
+		}
+		if handover.Type == "" {
+			handover.Type = stringValue(jsonPathFirst(h, "$.handoverType.id"))
+		}
+		if handover.URL != "" {
+			handovers = append(handovers, handover)
+		}
+	}
+	return handovers
+}
+
+
+// Interpret a value as an exists flag: booleans, counts, or words to that
+// effect. Anything else, including null, means the answer is unknown.
+func existsValue(v interface{}) *bool {
+	var exists bool
+	switch e := v.(type) {
+	case bool:
+		exists = e
+	case float64:
+		exists = e > 0
+	case string:
+		switch strings.ToLower(e) {
+		case "true", "yes", "found", "1":
+			exists = true
+		case "false", "no", "not found", "0":
+			exists = false
+		default:
+			return nil
+		}
+	default:
+		return nil
+	}
+	return &exists
+}
+
+
+// Interpret a value as a number, which may be given as a string. Values that
+// aren't finite, such as "NaN" or "Inf", are taken as absent.
+func numberValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+	}
+	return 0, false
+}
+
+
+// Interpret a value as a string; numbers, as identifiers sometimes are, are
+// written out
+func stringValue(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case float64:
+		return fmt.Sprint(s)
+	}
+	return ""
+}
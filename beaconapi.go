@@ -0,0 +1,433 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package main
+
+// Expose the beacon-of-beacons itself as a beacon (v0.3/v1.0 style API)
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"github.com/knoxcarey/bob/idp"
+	"github.com/knoxcarey/bob/beacon"
+)
+
+
+// Identification of this beacon
+const (
+	bobBeaconId   = "org.ga4gh.beacon-of-beacons"
+	bobName       = "Beacon of Beacons"
+	bobApiVersion = "1.0.0"
+)
+
+// Allele request, as accepted by the query endpoint and echoed in the response
+type alleleRequest struct {
+	ReferenceName           string    `json:"referenceName"`
+	Start                   *int64    `json:"start,omitempty"`
+	End                     *int64    `json:"end,omitempty"`
+	StartMin                *int64    `json:"startMin,omitempty"`
+	StartMax                *int64    `json:"startMax,omitempty"`
+	EndMin                  *int64    `json:"endMin,omitempty"`
+	EndMax                  *int64    `json:"endMax,omitempty"`
+	ReferenceBases          string    `json:"referenceBases,omitempty"`
+	AlternateBases          string    `json:"alternateBases,omitempty"`
+	AssemblyId              string    `json:"assemblyId,omitempty"`
+	VariantType             string    `json:"variantType,omitempty"`
+	DatasetIds              []string  `json:"datasetIds,omitempty"`
+	IncludeDatasetResponses string    `json:"includeDatasetResponses,omitempty"`
+	HGVS                    string    `json:"hgvs,omitempty"`
+	Variant                 string    `json:"variant,omitempty"`
+}
+
+// Error object, as defined by the beacon API
+type beaconError struct {
+	ErrorCode    int     `json:"errorCode"`
+	ErrorMessage string  `json:"errorMessage"`
+}
+
+// Handover, as defined by the beacon API
+type handover struct {
+	HandoverType  *handoverType  `json:"handoverType,omitempty"`
+	Note          string         `json:"note,omitempty"`
+	URL           string         `json:"url"`
+}
+
+// Kind of handover
+type handoverType struct {
+	Id     string  `json:"id,omitempty"`
+	Label  string  `json:"label,omitempty"`
+}
+
+// Result for a single upstream dataset
+type datasetAlleleResponse struct {
+	DatasetId        string                  `json:"datasetId"`
+	Exists           *bool                   `json:"exists"`
+	Error            *beaconError            `json:"error,omitempty"`
+	Frequency        *float64                `json:"frequency,omitempty"`
+	VariantCount     *int64                  `json:"variantCount,omitempty"`
+	CallCount        *int64                  `json:"callCount,omitempty"`
+	SampleCount      *int64                  `json:"sampleCount,omitempty"`
+	Note             string                  `json:"note,omitempty"`
+	ExternalURL      string                  `json:"externalUrl,omitempty"`
+	DatasetHandover  []handover              `json:"datasetHandover,omitempty"`
+	Info             map[string]interface{}  `json:"info,omitempty"`
+}
+
+// Response from the query endpoint
+type alleleResponse struct {
+	BeaconId                string                   `json:"beaconId"`
+	ApiVersion              string                   `json:"apiVersion"`
+	Exists                  *bool                    `json:"exists"`
+	AlleleRequest           *alleleRequest           `json:"alleleRequest,omitempty"`
+	DatasetAlleleResponses  []datasetAlleleResponse  `json:"datasetAlleleResponses,omitempty"`
+	BeaconHandover          []handover               `json:"beaconHandover,omitempty"`
+	Error                   *beaconError             `json:"error,omitempty"`
+}
+
+
+// Describe this beacon and the upstream datasets it aggregates
+func beaconInfoHandler(w http.ResponseWriter, r *http.Request) {
+	type dataset struct {
+		Id    string  `json:"id"`
+		Name  string  `json:"name"`
+	}
+
+	datasets := make([]dataset, 0)
+	for name, ids := range beacon.Datasets() {
+		if len(ids) == 0 {
+			datasets = append(datasets, dataset{Id: name, Name: name})
+		}
+		for _, id := range ids {
+			datasets = append(datasets, dataset{Id: datasetId(name, id), Name: name + " " + id})
+		}
+	}
+	sort.Slice(datasets, func(i, j int) bool { return datasets[i].Id < datasets[j].Id })
+
+	info := struct {
+		Id          string     `json:"id"`
+		Name        string     `json:"name"`
+		ApiVersion  string     `json:"apiVersion"`
+		Description string     `json:"description"`
+		Datasets    []dataset  `json:"datasets"`
+	}{bobBeaconId, bobName, bobApiVersion, "Aggregates the responses of multiple upstream beacons", datasets}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+
+// Answer a beacon query by querying all upstream beacons
+func beaconQueryHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := parseAlleleRequest(r)
+	if err != nil {
+		writeBeaconError(w, err)
+		return
+	}
+
+	query, err := requestQuery(req)
+	if err != nil {
+		writeBeaconError(w, err)
+		return
+	}
+
+	responses := beacon.QueryBeaconsSync(r.Context(), *query, requestPrincipal(r), timeout)
+
+	writeJSON(w, http.StatusOK, foldResponses(req, responses))
+}
+
+
+// Build a validated query from an allele request
+func requestQuery(req *alleleRequest) (*beacon.BeaconQuery, error) {
+	query := &beacon.BeaconQuery{
+		ReferenceName: req.ReferenceName,
+		Start: req.Start,
+		End: req.End,
+		StartMin: req.StartMin,
+		StartMax: req.StartMax,
+		EndMin: req.EndMin,
+		EndMax: req.EndMax,
+		ReferenceBases: req.ReferenceBases,
+		AlternateBases: req.AlternateBases,
+		AssemblyId: req.AssemblyId,
+		VariantType: req.VariantType,
+	}
+
+	switch {
+	case req.HGVS != "" && req.Variant != "":
+		return nil, errors.New("variant: cannot be combined with hgvs")
+
+	case req.HGVS != "":
+		var err error
+		if query, err = query.WithHGVS(req.HGVS); err != nil {
+			return nil, err
+		}
+
+	case req.Variant != "":
+		// An allele request describes a single allele
+		queries, err := query.WithVariant(req.Variant)
+		if err != nil {
+			return nil, err
+		}
+		if len(queries) > 1 {
+			return nil, errors.New("variant: describes more than one alternate allele; query each separately")
+		}
+		query = &queries[0]
+	}
+
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+
+	return query, nil
+}
+
+
+// Read an allele request from the query string (GET) or JSON body (POST)
+func parseAlleleRequest(r *http.Request) (*alleleRequest, error) {
+	req := &alleleRequest{}
+
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return nil, errors.New("malformed request body")
+		}
+	} else {
+		q := r.URL.Query()
+		req.ReferenceName = q.Get("referenceName")
+		req.ReferenceBases = q.Get("referenceBases")
+		req.AlternateBases = q.Get("alternateBases")
+		req.AssemblyId = q.Get("assemblyId")
+		req.VariantType = q.Get("variantType")
+		req.DatasetIds = q["datasetIds"]
+		req.IncludeDatasetResponses = q.Get("includeDatasetResponses")
+		req.HGVS = q.Get("hgvs")
+		req.Variant = q.Get("variant")
+		positions := map[string]**int64{
+			"start": &req.Start, "end": &req.End,
+			"startMin": &req.StartMin, "startMax": &req.StartMax,
+			"endMin": &req.EndMin, "endMax": &req.EndMax,
+		}
+		for name, field := range positions {
+			if s := q.Get(name); s != "" {
+				n, err := strconv.ParseInt(s, 10, 64)
+				if err != nil {
+					return nil, errors.New(name + ": must be an integer")
+				}
+				*field = &n
+			}
+		}
+	}
+
+	switch strings.ToUpper(req.IncludeDatasetResponses) {
+	case "":
+		req.IncludeDatasetResponses = "ALL"
+	case "ALL", "HIT", "MISS", "NONE":
+		req.IncludeDatasetResponses = strings.ToUpper(req.IncludeDatasetResponses)
+	default:
+		return nil, errors.New("includeDatasetResponses must be one of ALL, HIT, MISS or NONE")
+	}
+
+	return req, nil
+}
+
+
+// Combine upstream responses into a single beacon response
+func foldResponses(req *alleleRequest, responses []beacon.BeaconResponse) alleleResponse {
+	exists := false
+	datasets := make([]datasetAlleleResponse, 0)
+
+	wanted := make(map[string]bool)
+	for _, d := range req.DatasetIds {
+		wanted[d] = true
+	}
+
+	var handovers []handover
+	for _, resp := range responses {
+		// Beacons with none of the datasets asked for have nothing to say
+		if resp.NotQueried != "" {
+			continue
+		}
+
+		if len(resp.Error) > 0 {
+			code, _ := strconv.Atoi(resp.Error["code"])
+			datasets = append(datasets, datasetAlleleResponse{
+				DatasetId: resp.Name,
+				Error: &beaconError{code, resp.Error["message"]},
+				Info: map[string]interface{}{"beacon": resp.Name},
+			})
+			continue
+		}
+
+		handovers = append(handovers, convertHandovers(resp.Handovers)...)
+
+		for id, result := range resp.Results {
+			did := datasetId(resp.Name, id)
+			if len(wanted) > 0 && !wanted[did] {
+				continue
+			}
+
+			dar := datasetAlleleResponse{
+				DatasetId: did,
+				Exists: result.Exists,
+				Frequency: result.Frequency,
+				VariantCount: result.VariantCount,
+				CallCount: result.CallCount,
+				SampleCount: result.SampleCount,
+				Note: result.Note,
+				ExternalURL: result.ExternalURL,
+				DatasetHandover: convertHandovers(result.Handovers),
+				Info: map[string]interface{}{"beacon": resp.Name},
+			}
+			if result.Info != nil {
+				dar.Info["upstream"] = result.Info
+			}
+			if result.Error != "" {
+				dar.Error = &beaconError{400, result.Error}
+				if len(result.Missing) > 0 {
+					dar.Error.ErrorCode = http.StatusForbidden
+				}
+			}
+			if result.Exists != nil && *result.Exists {
+				exists = true
+			}
+			datasets = append(datasets, dar)
+		}
+	}
+
+	sort.Slice(datasets, func(i, j int) bool { return datasets[i].DatasetId < datasets[j].DatasetId })
+
+	return alleleResponse{
+		BeaconId: bobBeaconId,
+		ApiVersion: bobApiVersion,
+		Exists: &exists,
+		AlleleRequest: req,
+		DatasetAlleleResponses: filterDatasets(datasets, req.IncludeDatasetResponses),
+		BeaconHandover: handovers,
+	}
+}
+
+
+// Express upstream handovers in the form the beacon API defines
+func convertHandovers(handovers []beacon.Handover) []handover {
+	var converted []handover
+	for _, h := range handovers {
+		c := handover{Note: h.Note, URL: h.URL}
+		if h.Type != "" {
+			c.HandoverType = &handoverType{Label: h.Type}
+		}
+		converted = append(converted, c)
+	}
+	return converted
+}
+
+
+// Select dataset responses according to the includeDatasetResponses setting
+func filterDatasets(datasets []datasetAlleleResponse, include string) []datasetAlleleResponse {
+	if include == "ALL" {
+		return datasets
+	}
+
+	filtered := make([]datasetAlleleResponse, 0, len(datasets))
+	if include == "NONE" {
+		return filtered
+	}
+
+	for _, d := range datasets {
+		hit := d.Exists != nil && *d.Exists
+		if (include == "HIT") == hit {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+
+// Name an upstream dataset uniquely, qualified by the beacon it came from
+func datasetId(beaconName string, dataset string) string {
+	if beaconName == dataset {
+		return beaconName
+	}
+	return beaconName + "/" + dataset
+}
+
+
+// The principal for a request: the bearer of the tokens in its headers, if
+// any; else the signed-in user, if any; else anonymous. Tokens in headers are
+// not verified, so their bearer is credited with no visas or claims, and
+// passes no beacon's requirements.
+func requestPrincipal(r *http.Request) *beacon.Principal {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return &beacon.Principal{AccessToken: strings.TrimPrefix(h, "Bearer "), IDToken: r.Header.Get("IDToken")}
+	}
+
+	var id string
+	if err := getCookie(r, &id); err == nil {
+		if a, err := idp.Session(id); err == nil {
+			return sessionPrincipal(a)
+		}
+	}
+
+	return &beacon.Principal{}
+}
+
+
+// The principal for a signed-in user, with the user's visas and claims, whose
+// tokens may be exchanged for beacons
+func sessionPrincipal(a *idp.Auth) *beacon.Principal {
+	p := &beacon.Principal{AccessToken: a.AccessToken, IDToken: a.IDToken, Claims: a.Claims}
+	if iss, ok := a.Claims["iss"].(string); ok {
+		if sub, ok := a.Claims["sub"].(string); ok && sub != "" {
+			p.Subject = iss + " " + sub
+		}
+	}
+	p.Exchange = func(ctx context.Context, audience string, scope string) (string, error) {
+		return idp.ExchangeToken(ctx, a.SessionID, audience, scope)
+	}
+	for _, v := range a.Visas {
+		p.Visas = append(p.Visas, beacon.Visa{Type: v.Type, Value: v.Value, Source: v.Source})
+	}
+	return p
+}
+
+
+// Report a problem with the request as a beacon error
+func writeBeaconError(w http.ResponseWriter, err error) {
+	writeJSON(w, http.StatusBadRequest, alleleResponse{
+		BeaconId: bobBeaconId,
+		ApiVersion: bobApiVersion,
+		Error: &beaconError{http.StatusBadRequest, err.Error()},
+	})
+}
+
+
+// Serialize a value as the JSON body of a response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Print("unable to encode response: ", err)
+		http.Error(w, "Unable to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
@@ -37,6 +37,12 @@ var (
 	port int                          // Port at which to operate service
 	timeout int                       // Timeout for beacon queries, in seconds
 	host string                       // Host for this service
+	cacheTTL int                      // Lifetime of cached positive responses, in seconds
+	cacheNegativeTTL int              // Lifetime of cached negative responses, in seconds
+	cacheDir string                   // Directory for on-disk cache; in memory if empty
+	referenceGRCh37 string            // Indexed FASTA for GRCh37; no normalization if empty
+	referenceGRCh38 string            // Indexed FASTA for GRCh38; no normalization if empty
+	metadataInterval int              // Seconds between fetches of beacon metadata
 )
 
 var (
@@ -44,11 +50,18 @@ var (
 	defaultPort       = 8080          // Default port for server
 	defaultTimeout    = 20            // Default timeout for queries, in seconds
 	defaultHost       = "127.0.0.1"   // Default host is localhost
+	defaultCacheTTL   = 0             // Default is not to cache responses
+	defaultCacheNegativeTTL = 0       // Default is not to cache negative responses
+	defaultCacheDir   = ""            // Default is to cache in memory
+	defaultReference  = ""            // Default is not to normalize variants
+	defaultMetadataInterval = 3600    // Default is to fetch metadata hourly
 )
 
 
-// Read in configuration and apply defaults
-func init() {	
+// Read in configuration and apply defaults. This is done by main, rather
+// than at initialization, so that tests of the server's handlers need no
+// configuration.
+func configure() {
 
 	// Initialize default config directory
 	_, dir, _, _ := runtime.Caller(0)
@@ -63,6 +76,29 @@ func init() {
 	// read in configuration files
 	readConfigs("beacon", func (file string) {beacon.AddBeaconFromConfig(file)})
 	readConfigs("idp", func (file string) {idp.AddIDPFromConfig(file)})
+
+	// Read chain files for lifting queries between assemblies
+	if err := beacon.LoadChains(configDir + "/liftover/"); err != nil {
+		log.Fatal(err)
+	}
+
+	// Read reference sequences for checking and normalizing variants
+	for assembly, file := range map[string]string{"GRCh37": referenceGRCh37, "GRCh38": referenceGRCh38} {
+		if file == "" {
+			continue
+		}
+		if err := beacon.LoadReference(assembly, file); err != nil {
+			log.Fatal("unable to read reference sequence: ", err)
+		}
+	}
+
+	// Fetch beacon and dataset metadata in the background
+	beacon.StartMetadataRefresh(metadataInterval)
+
+	// Set up cache of beacon responses
+	if err := beacon.ConfigureCache(cacheTTL, cacheNegativeTTL, cacheDir); err != nil {
+		log.Fatal("unable to create cache directory ", cacheDir)
+	}
 }
 
 
@@ -72,6 +108,12 @@ func parseSwitches() {
 	flag.StringVar(&host, "host", defaultHost, "Host name")
 	flag.IntVar(&port, "port", defaultPort, "Port on which to run server")
 	flag.IntVar(&timeout, "timeout", defaultTimeout, "Timeout for beacon queries, in seconds")
+	flag.IntVar(&cacheTTL, "cache-ttl", defaultCacheTTL, "Lifetime of cached positive responses, in seconds (0 to disable)")
+	flag.IntVar(&cacheNegativeTTL, "cache-negative-ttl", defaultCacheNegativeTTL, "Lifetime of cached negative responses, in seconds (0 to disable)")
+	flag.StringVar(&cacheDir, "cache-dir", defaultCacheDir, "Directory for on-disk response cache (default in memory)")
+	flag.StringVar(&referenceGRCh37, "reference-grch37", defaultReference, "Indexed FASTA file of the GRCh37 reference, for normalizing variants")
+	flag.StringVar(&referenceGRCh38, "reference-grch38", defaultReference, "Indexed FASTA file of the GRCh38 reference, for normalizing variants")
+	flag.IntVar(&metadataInterval, "metadata-interval", defaultMetadataInterval, "Seconds between fetches of beacon and dataset metadata (0 to disable)")
 	flag.Parse()
 }
 
@@ -0,0 +1,137 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package idp
+
+// Token exchange (RFC 8693): the user's access token is traded with the
+// identity provider for one that only a given beacon will accept, so that
+// beacons never see the user's own tokens
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+
+// Reply of the token endpoint to an exchange
+type exchangeResponse struct {
+	AccessToken       string  `json:"access_token"`
+	IssuedTokenType   string  `json:"issued_token_type"`
+	ExpiresIn         int64   `json:"expires_in"`
+	Error             string  `json:"error"`
+	ErrorDescription  string  `json:"error_description"`
+}
+
+
+// Token types and grant type of RFC 8693
+const (
+	tokenExchangeGrant = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType    = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+
+// Exchange a session's access token for one restricted to an audience, and
+// to a scope if one is given. Exchanged tokens are kept, and reused until
+// they are about to expire.
+func ExchangeToken(ctx context.Context, id string, audience string, scope string) (string, error) {
+	auth, err := Session(id)
+	if err != nil {
+		return "", err
+	}
+
+	sessions.mutex.Lock()
+	s, ok := sessions.sessions[id]
+	sessions.mutex.Unlock()
+	if !ok {
+		return "", ErrSessionExpired
+	}
+
+	key := audience + " " + scope
+	s.mutex.Lock()
+	token, ok := s.exchanged[key]
+	s.mutex.Unlock()
+	if ok && time.Until(token.Expiry) > refreshMargin {
+		return token.AccessToken, nil
+	}
+
+	token, err = exchange(ctx, &providers[auth.ProviderIdx], auth.AccessToken, audience, scope)
+	if err != nil {
+		return "", err
+	}
+
+	// Tokens of unknown lifetime are used only once
+	if !token.Expiry.IsZero() {
+		s.mutex.Lock()
+		if s.exchanged == nil {
+			s.exchanged = make(map[string]*oauth2.Token)
+		}
+		s.exchanged[key] = token
+		s.mutex.Unlock()
+	}
+	return token.AccessToken, nil
+}
+
+
+// Ask a provider's token endpoint to exchange an access token
+func exchange(ctx context.Context, idp *Provider, accessToken string, audience string, scope string) (*oauth2.Token, error) {
+	form := url.Values{}
+	form.Set("grant_type", tokenExchangeGrant)
+	form.Set("subject_token", accessToken)
+	form.Set("subject_token_type", accessTokenType)
+	form.Set("requested_token_type", accessTokenType)
+	form.Set("audience", audience)
+	if scope != "" {
+		form.Set("scope", scope)
+	}
+
+	r, err := http.NewRequest("POST", idp.config.Endpoint.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(url.QueryEscape(idp.config.ClientID), url.QueryEscape(idp.config.ClientSecret))
+
+	resp, err := http.DefaultClient.Do(r.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("token exchange failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var reply exchangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("token exchange failed: %s", resp.Status)
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("token exchange refused: %s %s", reply.Error, reply.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || reply.AccessToken == "" {
+		return nil, fmt.Errorf("token exchange failed: %s", resp.Status)
+	}
+
+	token := &oauth2.Token{AccessToken: reply.AccessToken}
+	if reply.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(reply.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
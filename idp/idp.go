@@ -19,16 +19,18 @@ package idp
 
 import (
 	"io/ioutil"
+	"crypto/subtle"
 	"encoding/base64"
-	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	oidc "github.com/coreos/go-oidc"
 	"golang.org/x/net/context"
@@ -46,6 +48,8 @@ type IDPConfig struct {
 	ClientSecret    string                      // Client secret embedded directly
 	ClientSecretEnv string                      // Environment variable with client secret
 	RedirectURL     string                      // URL the provider should redirect to
+	PassportBroker  string                      // URL of GA4GH passport broker; else user info
+	VisaIssuers     []string                    // Issuers whose visas are accepted; the provider if empty
 	// Need to add config options like icons for redirect page
 }
 
@@ -59,37 +63,24 @@ type Provider struct {
 	idpconfig  *IDPConfig                       // Pointer to struct read from config file
 }
 
-// Structure for recording an outstanding auth request
-type authRequest struct {
-	idpi int                                    // Index of dentity provider auth request went to
-	url  string                                 // Original URL that was requested
-}
-
 // Structure to contain response data from identity provider
 type Auth struct {
 	URL         string                          // URL originally requested
 	AccessToken string                          // Access token for session
 	IDToken     string                          // Identity token
-	ExpiresIn   int                             // Timeout for session
+	ExpiresIn   int                             // Seconds until tokens expire (0: unknown)
 	Name        string                          // Authenticated user's name
 	ProviderIdx int                             // Index of provider that authenticated
+	SessionID   string                          // Server-side session holding tokens
+	Visas       []Visa                          // Valid visas from user's GA4GH passport
+	Claims      map[string]interface{}          // Claims of verified ID token
 }
 
 
 var providers []Provider                            // List of identity providers
-var requests  map[string]authRequest                // Maps of requests by ephemeral nonce
 
-
-// Initialize module globals
-func init() {
-	requests  = make(map[string]authRequest)
-}
-
-
-// Register Auth type so that it can be serialized (into cookie)
-func init() {
-	gob.Register(&Auth{})
-}
+// Cookie binding a sign-in attempt to the browser that started it
+const stateCookie = "login-state"
 
 
 // Return list of providers
@@ -131,10 +122,22 @@ func AddIDPFromConfig(file string) {
                 log.Fatal("could not reach identity provider: ", idpc.Name)
         }
 
-	// Extract revocation endpoint from provider claims
-	var claims map[string]string
+	// Extract revocation endpoint and supported scopes from provider claims
+	var claims struct {
+		Issuer      string    `json:"issuer"`
+		Revocation  string    `json:"revocation_endpoint"`
+		Scopes      []string  `json:"scopes_supported"`
+	}
 	provider.Claims(&claims)
-	idpc.Revocation = claims["revocation_endpoint"]
+	idpc.Revocation = claims.Revocation
+
+	// Unless told otherwise, trust only the provider's own visas
+	if len(idpc.VisaIssuers) == 0 {
+		idpc.VisaIssuers = []string{claims.Issuer}
+		if claims.Issuer == "" {
+			idpc.VisaIssuers = []string{idpc.Endpoint}
+		}
+	}
 	
         oidcConfig := &oidc.Config{ClientID: idpc.ClientID}
 
@@ -148,6 +151,14 @@ func AddIDPFromConfig(file string) {
                 Scopes:       []string{oidc.ScopeOpenID, "profile", "email", "ga4gh"},
         }
 
+	// Ask for a refresh token, if the provider issues them on request, and
+	// for a passport by the current scope's name, if the provider knows it
+	for _, scope := range claims.Scopes {
+		if scope == oidc.ScopeOfflineAccess || scope == "ga4gh_passport_v1" {
+			config.Scopes = append(config.Scopes, scope)
+		}
+	}
+
 	idp := Provider{
 		Name: idpc.Name,
 		context:  &ctx,
@@ -162,30 +173,90 @@ func AddIDPFromConfig(file string) {
 }
 
 
-// Handle redirect to IdP indexed by pi
+// Handle redirect to IdP indexed by pi. The request is recorded under a
+// random state, along with a nonce for the ID token and a PKCE verifier, and
+// the state is also set in a cookie, so that only this browser can finish
+// signing in.
 func Authenticate(pi int, w http.ResponseWriter, r *http.Request) {
-	state := nonce(32)
+	if pi < 0 || pi >= len(providers) {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+		return
+	}
 	idp := &providers[pi]
-	url, err := url.QueryUnescape(r.URL.Query().Get("page"))
+
+	page, err := url.QueryUnescape(r.URL.Query().Get("page"))
+	if err != nil || !localPage(page) {
+		page = "/"
+	}
+
+	nonce, err1 := randomString(32)
+	verifier, err2 := randomString(32)
+	if err1 != nil || err2 != nil {
+		http.Error(w, "Unable to start sign-in", http.StatusInternalServerError)
+		return
+	}
+
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		http.Error(w, "bad request", http.StatusInternalServerError)
+		client = r.RemoteAddr
 	}
-	requests[state] = authRequest{
-		idpi: pi,
-		url: url,
+
+	state, err := requests.put(authRequest{idpi: pi, url: page, nonce: nonce, verifier: verifier, client: client})
+	if err == ErrTooManyLogins {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		http.Error(w, "Unable to start sign-in", http.StatusInternalServerError)
+		return
 	}
-	http.Redirect(w, r, idp.config.AuthCodeURL(state), http.StatusFound)
+
+	http.SetCookie(w, &http.Cookie{
+		Name: stateCookie,
+		Value: state,
+		Path: "/",
+		MaxAge: int(requestTTL / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	authURL := idp.config.AuthCodeURL(state,
+		oidc.Nonce(nonce),
+		oauth2.SetAuthURLParam("code_challenge", codeChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+	http.Redirect(w, r, authURL, http.StatusFound)
 }
 
 
-// Send revocation request to IdP
-func Logout(pi int, accessToken string) {
+// Whether a page to return to after signing in is on this site
+func localPage(page string) bool {
+	return strings.HasPrefix(page, "/") && !strings.HasPrefix(page, "//") && !strings.HasPrefix(page, "/\\")
+}
+
+
+// Check that an access token was issued by one of the identity providers, by
+// asking each in turn for the user info the token gives access to
+func VerifyAccessToken(ctx context.Context, token string) error {
+	if token == "" {
+		return errors.New("no access token")
+	}
+	for i := range providers {
+		source := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token, TokenType: "Bearer"})
+		if _, err := providers[i].provider.UserInfo(ctx, source); err == nil {
+			return nil
+		}
+	}
+	return errors.New("access token is not accepted by any identity provider")
+}
+
+
+// Send revocation request to IdP for a token of the given type
+func revoke(pi int, token string, tokenType string) {
 	idp := &providers[pi]
 	auth := fmt.Sprintf("%s:%s", idp.idpconfig.ClientID, idp.idpconfig.ClientSecret)
 	encoded := base64.StdEncoding.EncodeToString([]byte(auth))
 	form := url.Values{}
-	form.Add("token", accessToken)
-	form.Add("token_type_hint", "access_token")
+	form.Add("token", token)
+	form.Add("token_type_hint", tokenType)
 	url := idp.idpconfig.Revocation
 	if r, e := http.NewRequest("POST", url, strings.NewReader(form.Encode())); e == nil {
 		r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
@@ -196,69 +267,87 @@ func Logout(pi int, accessToken string) {
 }
 
 
-// Handle callback from IdP
+// Handle callback from IdP. The state must match a request made from this
+// browser that has neither expired nor been used before; the authorization
+// code is exchanged with the PKCE verifier, and the ID token must carry the
+// request's nonce. Errors are returned for the caller to report.
 func Callback(w http.ResponseWriter, r *http.Request) (Auth, error) {
 	// Extract state from IDP response
 	state := r.URL.Query().Get("state")
 
-	// Determine which IDP that request was to
-	idpi := requests[state].idpi
-	idp := &providers[idpi]
+	// Determine which request, and so which IDP, this is the answer to
+	req, err := requests.take(state)
+	if err != nil {
+		return Auth{}, err
+	}
+	idp := &providers[req.idpi]
+
+	// Check that the request was made from this browser
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+	if cookie, err := r.Cookie(stateCookie); err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return Auth{}, ErrUnknownState
+	}
+
+	// The IDP may report that the user didn't sign in
+	if e := r.URL.Query().Get("error"); e != "" {
+		return Auth{}, fmt.Errorf("the identity provider reported %s: %s", e, r.URL.Query().Get("error_description"))
+	}
 
-	// Make sure requests map gets cleaned up when we're done
-	defer delete(requests, state)
-	
 	// Get the OAUTH token
-	oauth2Token, err := idp.config.Exchange(*idp.context, r.URL.Query().Get("code"))
+	oauth2Token, err := idp.config.Exchange(*idp.context, r.URL.Query().Get("code"),
+		oauth2.SetAuthURLParam("code_verifier", req.verifier))
 	if err != nil {
-		http.Error(w, "Failed to exchange token: "+err.Error(), http.StatusInternalServerError)
-		return Auth{}, err
+		return Auth{}, fmt.Errorf("failed to exchange token: %v", err)
 	}
 
 	// Get raw version of ID token
 	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
 	if !ok {
-		http.Error(w, "No id_token field in oauth2 token.", http.StatusInternalServerError)
-		return Auth{}, err
+		return Auth{}, errors.New("no id_token field in oauth2 token")
 	}
 
-	// Verify it
-	if _, err := idp.verifier.Verify(*idp.context, rawIDToken); err != nil {
-		http.Error(w, "Failed to verify ID Token: "+err.Error(), http.StatusInternalServerError)
-		return Auth{}, err
+	// Verify it, and that it was issued for this request
+	idToken, err := idp.verifier.Verify(*idp.context, rawIDToken)
+	if err != nil {
+		return Auth{}, fmt.Errorf("failed to verify ID token: %v", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(req.nonce)) != 1 {
+		return Auth{}, errors.New("ID token was not issued for this sign-in attempt")
 	}
 
 	// Fetch userinfo
 	userInfo, err := idp.provider.UserInfo(*idp.context, oauth2.StaticTokenSource(oauth2Token))
 	if err != nil {
-		http.Error(w, "Failed to get userinfo: "+err.Error(), http.StatusInternalServerError)
-		return Auth{}, err
+		return Auth{}, fmt.Errorf("failed to get userinfo: %v", err)
 	}
 
 	var claims map[string]interface{}
 	userInfo.Claims(&claims)
-	name := claims["given_name"].(string) + " " + claims["family_name"].(string)
-	
+	givenName, _ := claims["given_name"].(string)
+	familyName, _ := claims["family_name"].(string)
+	name := strings.TrimSpace(givenName + " " + familyName)
+
 	resp := Auth{
-		URL: requests[state].url,
-		AccessToken: oauth2Token.Extra("access_token").(string),
+		URL: req.url,
+		AccessToken: oauth2Token.AccessToken,
 		IDToken: rawIDToken,
-		ExpiresIn: int(oauth2Token.Extra("expires_in").(float64)),
-		ProviderIdx: idpi,
+		ProviderIdx: req.idpi,
 		Name: name,
 	}
 
-	return resp, nil
-}
-
+	if err := idToken.Claims(&resp.Claims); err != nil {
+		return Auth{}, fmt.Errorf("failed to read ID token claims: %v", err)
+	}
 
+	// Collect the user's visas; without them, the user may still query
+	if resp.Visas, err = fetchPassport(idp, oauth2Token, claims); err != nil {
+		log.Print("unable to fetch passport: ", err)
+	}
 
-// Generate a random nonce string
-var digits = [...]string{"0","1","2","3","4","5","6","7","8","9","a","b","c","d","e","f"}
-func nonce(len int) string {
-	n := ""
-	for i := 0; i < len; i++ {
-		n += digits[rand.Intn(16)]
+	// Keep the tokens, including any refresh token, on the server
+	if resp.SessionID, err = newSession(resp, oauth2Token, idToken.Expiry); err != nil {
+		return Auth{}, err
 	}
-	return n
+
+	return resp, nil
 }
@@ -0,0 +1,453 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package idp
+
+// GA4GH Passports: the visas that a user's identity provider, or a passport
+// broker, holds for them. Each visa is a JWT, checked against the keys of
+// the issuer that signed it.
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+)
+
+
+// Standard visa types
+const (
+	ControlledAccessGrants     = "ControlledAccessGrants"
+	AffiliationAndRole         = "AffiliationAndRole"
+	AcceptedTermsAndPolicies   = "AcceptedTermsAndPolicies"
+	ResearcherStatus           = "ResearcherStatus"
+	LinkedIdentities           = "LinkedIdentities"
+)
+
+
+// A visa: something asserted about the user, by whom, and until when
+type Visa struct {
+	Type         string            `json:"type"`
+	Value        string            `json:"value"`                  // e.g. dataset URL for ControlledAccessGrants
+	Source       string            `json:"source"`                 // Organization that made the assertion
+	By           string            `json:"by,omitempty"`           // Role of the person who made it
+	Asserted     time.Time         `json:"asserted"`
+	Expires      time.Time         `json:"expires"`
+	Issuer       string            `json:"issuer"`                 // Issuer of the visa's JWT
+	Subject      string            `json:"subject"`                // User, as the issuer knows them
+	Conditions   [][]Condition     `json:"conditions,omitempty"`   // Any one list must be met in full
+	Role         string            `json:"role,omitempty"`         // AffiliationAndRole: e.g. faculty
+	Affiliation  string            `json:"affiliation,omitempty"`  // AffiliationAndRole: organization's domain
+	Identities   []LinkedIdentity  `json:"identities,omitempty"`   // LinkedIdentities
+}
+
+// A condition on a visa, met by another of the user's visas. Values may be
+// given as const:<value>, pattern:<glob> or split_pattern:<glob>;<glob>...
+type Condition struct {
+	Type    string  `json:"type"`
+	Value   string  `json:"value,omitempty"`
+	Source  string  `json:"source,omitempty"`
+	By      string  `json:"by,omitempty"`
+}
+
+// An identity of the user's at another issuer
+type LinkedIdentity struct {
+	Subject  string  `json:"subject"`
+	Issuer   string  `json:"issuer"`
+}
+
+// Claims of a visa's JWT
+type visaClaims struct {
+	Issuer    string  `json:"iss"`
+	Subject   string  `json:"sub"`
+	IssuedAt  int64   `json:"iat"`
+	Expiry    int64   `json:"exp"`
+	Visa      *struct {
+		Type        string         `json:"type"`
+		Asserted    int64          `json:"asserted"`
+		Value       string         `json:"value"`
+		Source      string         `json:"source"`
+		By          string         `json:"by"`
+		Conditions  [][]Condition  `json:"conditions"`
+	} `json:"ga4gh_visa_v1"`
+}
+
+// Concurrency-safe cache of issuers' key sets, by the URL of the set
+type keySetCache struct {
+	mutex    sync.Mutex
+	keySets  map[string]oidc.KeySet
+	jwksURLs map[string]string                  // Key set URL, by issuer
+}
+
+
+// Time allowed for fetching a passport, or an issuer's keys
+const passportTimeout = 10 * time.Second
+
+// Allowance for clocks that disagree, when checking times in visas
+const clockSkew = time.Minute
+
+// Key sets of visa issuers
+var visaKeys = &keySetCache{keySets: make(map[string]oidc.KeySet), jwksURLs: make(map[string]string)}
+
+
+// Fetch a user's passport from the provider's passport broker if it has one,
+// or else from the user info, which may already have been fetched, and keep
+// the visas that are valid. A passport's visas are all issued to the user
+// that the token identifies, so there is no need to check whose they are.
+func fetchPassport(idp *Provider, token *oauth2.Token, userInfo map[string]interface{}) ([]Visa, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), passportTimeout)
+	defer cancel()
+
+	var claims struct {
+		Passport []string `json:"ga4gh_passport_v1"`
+	}
+
+	switch {
+	case idp.idpconfig.PassportBroker != "":
+		req, err := http.NewRequest("GET", idp.idpconfig.PassportBroker, nil)
+		if err != nil {
+			return nil, err
+		}
+		token.SetAuthHeader(req)
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("passport broker: %s", resp.Status)
+		}
+		if err := json.Unmarshal(body, &claims); err != nil {
+			return nil, fmt.Errorf("passport broker: %v", err)
+		}
+
+	case userInfo != nil:
+		for _, v := range asList(userInfo["ga4gh_passport_v1"]) {
+			if s, ok := v.(string); ok {
+				claims.Passport = append(claims.Passport, s)
+			}
+		}
+
+	default:
+		info, err := idp.provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+		if err != nil {
+			return nil, err
+		}
+		if err := info.Claims(&claims); err != nil {
+			return nil, err
+		}
+	}
+
+	var visas []Visa
+	for _, raw := range claims.Passport {
+		visa, err := verifyVisa(ctx, idp, raw)
+		if err != nil {
+			log.Print("ignoring visa: ", err)
+			continue
+		}
+		visas = append(visas, *visa)
+	}
+
+	return conditionsMet(visas), nil
+}
+
+
+// Check a visa's signature, against the keys of the issuer it names, and its
+// times, and decode it. The keys are found by the issuer's OpenID Connect
+// discovery document or, for visas in the document token format, at the URL
+// in the visa's jku header, which must be on the issuer's own host.
+func verifyVisa(ctx context.Context, idp *Provider, raw string) (*Visa, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed visa")
+	}
+
+	var header struct {
+		JKU string `json:"jku"`
+	}
+	var claims visaClaims
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed visa header: %v", err)
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed visa claims: %v", err)
+	}
+	if claims.Issuer == "" {
+		return nil, errors.New("visa names no issuer")
+	}
+	if !containsString(idp.idpconfig.VisaIssuers, claims.Issuer) {
+		return nil, fmt.Errorf("visa issuer %s is not trusted", claims.Issuer)
+	}
+
+	keySet, err := visaKeys.forIssuer(ctx, claims.Issuer, header.JKU)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := keySet.VerifySignature(ctx, raw)
+	if err != nil {
+		return nil, fmt.Errorf("visa from %s: %v", claims.Issuer, err)
+	}
+
+	// Only what was signed is believed
+	claims = visaClaims{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed visa claims: %v", err)
+	}
+
+	now := time.Now()
+	v := claims.Visa
+	switch {
+	case v == nil || v.Type == "" || v.Value == "" || v.Source == "":
+		return nil, fmt.Errorf("visa from %s lacks type, value or source", claims.Issuer)
+	case claims.Expiry == 0 || now.After(time.Unix(claims.Expiry, 0)):
+		return nil, fmt.Errorf("%s visa from %s has expired", v.Type, claims.Issuer)
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(clockSkew)) || time.Unix(v.Asserted, 0).After(now.Add(clockSkew)):
+		return nil, fmt.Errorf("%s visa from %s is dated in the future", v.Type, claims.Issuer)
+	}
+
+	visa := &Visa{
+		Type: v.Type,
+		Value: v.Value,
+		Source: v.Source,
+		By: v.By,
+		Asserted: time.Unix(v.Asserted, 0),
+		Expires: time.Unix(claims.Expiry, 0),
+		Issuer: claims.Issuer,
+		Subject: claims.Subject,
+		Conditions: v.Conditions,
+	}
+
+	switch visa.Type {
+	case AffiliationAndRole:
+		if i := strings.Index(visa.Value, "@"); i >= 0 {
+			visa.Role, visa.Affiliation = visa.Value[:i], visa.Value[i+1:]
+		}
+	case LinkedIdentities:
+		visa.Identities = parseLinkedIdentities(visa.Value)
+	}
+
+	return visa, nil
+}
+
+
+// Key set with which an issuer signs visas, found at jku if given, or else by
+// discovery; key sets are cached and refresh themselves
+func (c *keySetCache) forIssuer(ctx context.Context, issuer string, jku string) (oidc.KeySet, error) {
+	c.mutex.Lock()
+	jwksURL := c.jwksURLs[issuer]
+	c.mutex.Unlock()
+
+	if jku != "" {
+		if !sameHost(jku, issuer) {
+			return nil, fmt.Errorf("visa from %s names keys on another host: %s", issuer, jku)
+		}
+		jwksURL = jku
+	}
+
+	if jwksURL == "" {
+		var err error
+		if jwksURL, err = discoverKeys(ctx, issuer); err != nil {
+			return nil, err
+		}
+		c.mutex.Lock()
+		c.jwksURLs[issuer] = jwksURL
+		c.mutex.Unlock()
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	keySet, ok := c.keySets[jwksURL]
+	if !ok {
+		keySet = oidc.NewRemoteKeySet(context.Background(), jwksURL)
+		c.keySets[jwksURL] = keySet
+	}
+	return keySet, nil
+}
+
+
+// URL of an issuer's keys, from its OpenID Connect discovery document
+func discoverKeys(ctx context.Context, issuer string) (string, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("unable to discover keys of visa issuer %s: %v", issuer, err)
+	}
+	defer resp.Body.Close()
+
+	var doc struct {
+		JWKS string `json:"jwks_uri"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&doc) != nil || doc.JWKS == "" {
+		return "", fmt.Errorf("visa issuer %s publishes no keys", issuer)
+	}
+	return doc.JWKS, nil
+}
+
+
+// Keep the visas whose conditions, if any, are met by the visas that have
+// none. (Conditions are not met by visas that are themselves conditional.)
+func conditionsMet(visas []Visa) []Visa {
+	var unconditional, met []Visa
+	for _, v := range visas {
+		if len(v.Conditions) == 0 {
+			unconditional = append(unconditional, v)
+		}
+	}
+
+	for _, v := range visas {
+		if len(v.Conditions) == 0 {
+			met = append(met, v)
+			continue
+		}
+		for _, all := range v.Conditions {
+			if allMet(all, unconditional) {
+				met = append(met, v)
+				break
+			}
+		}
+	}
+	return met
+}
+
+
+// Whether each of a list of conditions is met by some visa
+func allMet(conditions []Condition, visas []Visa) bool {
+	for _, c := range conditions {
+		found := false
+		for _, v := range visas {
+			if c.Type == v.Type && conditionMatches(c.Value, v.Value) &&
+				conditionMatches(c.Source, v.Source) && conditionMatches(c.By, v.By) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+
+// Whether a condition's field matches a visa's; an empty field matches anything
+func conditionMatches(condition string, value string) bool {
+	switch {
+	case condition == "":
+		return true
+	case strings.HasPrefix(condition, "const:"):
+		return value == strings.TrimPrefix(condition, "const:")
+	case strings.HasPrefix(condition, "pattern:"):
+		return globMatches(strings.TrimPrefix(condition, "pattern:"), value)
+	case strings.HasPrefix(condition, "split_pattern:"):
+		for _, part := range strings.Split(value, ";") {
+			if globMatches(strings.TrimPrefix(condition, "split_pattern:"), part) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+
+// Whether a value matches a pattern in which ? stands for any character,
+// and * for any run of them
+func globMatches(pattern string, value string) bool {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	matched, err := regexp.MatchString("^" + expr + "$", value)
+	return err == nil && matched
+}
+
+
+// Decode a LinkedIdentities value: subject,issuer pairs, URL-encoded and
+// separated by semicolons
+func parseLinkedIdentities(value string) []LinkedIdentity {
+	var identities []LinkedIdentity
+	for _, pair := range strings.Split(value, ";") {
+		fields := strings.SplitN(pair, ",", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		subject, err1 := url.QueryUnescape(fields[0])
+		issuer, err2 := url.QueryUnescape(fields[1])
+		if err1 == nil && err2 == nil {
+			identities = append(identities, LinkedIdentity{Subject: subject, Issuer: issuer})
+		}
+	}
+	return identities
+}
+
+
+// Decode a segment of a JWT, without checking its signature
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+
+// Whether two URLs are on the same scheme and host
+func sameHost(a string, b string) bool {
+	ua, err1 := url.Parse(a)
+	ub, err2 := url.Parse(b)
+	return err1 == nil && err2 == nil && ua.Scheme == ub.Scheme && ua.Host != "" && ua.Host == ub.Host
+}
+
+
+// A value as a list; a single value becomes a list of one
+func asList(v interface{}) []interface{} {
+	if list, ok := v.([]interface{}); ok {
+		return list
+	}
+	if v == nil {
+		return nil
+	}
+	return []interface{}{v}
+}
+
+
+// Whether a list of strings includes one
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
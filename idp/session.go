@@ -0,0 +1,209 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package idp
+
+// Sessions of signed-in users, kept on the server with their tokens, which
+// are refreshed before they expire
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+
+// Tokens for a signed-in user
+type session struct {
+	mutex         sync.Mutex
+	auth          Auth
+	refreshToken  string                        // Refresh token, if the provider issued one
+	expiry        time.Time                     // When the access or ID token expires; zero if never
+	lastUsed      time.Time
+	exchanged     map[string]*oauth2.Token      // Tokens exchanged for beacons, by audience and scope
+}
+
+// Concurrency-safe store of sessions, by ID
+type sessionStore struct {
+	mutex     sync.Mutex
+	sessions  map[string]*session
+}
+
+
+// Time a session lasts without being used
+const SessionLifetime = 12 * time.Hour
+
+// Tokens are refreshed when they have less than this long left
+const refreshMargin = time.Minute
+
+// Error for sessions that have ended, or whose tokens could not be refreshed
+var ErrSessionExpired = errors.New("session expired; please sign in again")
+
+
+// Sessions of signed-in users
+var sessions = &sessionStore{sessions: make(map[string]*session)}
+
+
+// Start a session with the tokens from signing in, returning its ID
+func newSession(auth Auth, token *oauth2.Token, idExpiry time.Time) (string, error) {
+	id, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	auth.SessionID = id
+
+	s := &session{auth: auth, refreshToken: token.RefreshToken, lastUsed: time.Now()}
+	s.setExpiry(token.Expiry, idExpiry)
+
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+
+	for id, old := range sessions.sessions {
+		if time.Since(old.lastUsed) > SessionLifetime {
+			delete(sessions.sessions, id)
+		}
+	}
+	sessions.sessions[id] = s
+	return id, nil
+}
+
+
+// Current tokens for a session, refreshed first if they are about to expire.
+// If they can't be refreshed, and have expired, the session ends.
+func Session(id string) (*Auth, error) {
+	sessions.mutex.Lock()
+	s, ok := sessions.sessions[id]
+	sessions.mutex.Unlock()
+	if !ok {
+		return nil, ErrSessionExpired
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastUsed) > SessionLifetime {
+		endSession(id)
+		return nil, ErrSessionExpired
+	}
+	s.lastUsed = now
+
+	if !s.expiry.IsZero() && s.expiry.Sub(now) < refreshMargin {
+		if err := s.refresh(); err != nil {
+			if now.After(s.expiry) {
+				log.Print("unable to refresh session tokens: ", err)
+				endSession(id)
+				return nil, ErrSessionExpired
+			}
+		}
+	}
+
+	auth := s.auth
+	if !s.expiry.IsZero() {
+		auth.ExpiresIn = int(time.Until(s.expiry) / time.Second)
+	}
+
+	// Visas that have expired since they were fetched are dropped
+	auth.Visas = nil
+	for _, v := range s.auth.Visas {
+		if now.Before(v.Expires) {
+			auth.Visas = append(auth.Visas, v)
+		}
+	}
+	return &auth, nil
+}
+
+
+// End a session, revoking its tokens with the provider
+func Logout(id string) {
+	sessions.mutex.Lock()
+	s, ok := sessions.sessions[id]
+	delete(sessions.sessions, id)
+	sessions.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	revoke(s.auth.ProviderIdx, s.auth.AccessToken, "access_token")
+	if s.refreshToken != "" {
+		revoke(s.auth.ProviderIdx, s.refreshToken, "refresh_token")
+	}
+}
+
+
+// Forget a session
+func endSession(id string) {
+	sessions.mutex.Lock()
+	delete(sessions.sessions, id)
+	sessions.mutex.Unlock()
+}
+
+
+// Obtain new tokens with the refresh token. Providers need not issue a new
+// ID token, or a new refresh token, in which case the old ones are kept.
+func (s *session) refresh() error {
+	if s.refreshToken == "" {
+		return errors.New("no refresh token")
+	}
+
+	idp := &providers[s.auth.ProviderIdx]
+	token, err := idp.config.TokenSource(*idp.context, &oauth2.Token{RefreshToken: s.refreshToken}).Token()
+	if err != nil {
+		return err
+	}
+
+	idExpiry := time.Time{}
+	if rawIDToken, ok := token.Extra("id_token").(string); ok {
+		idToken, err := idp.verifier.Verify(*idp.context, rawIDToken)
+		if err != nil {
+			return err
+		}
+		var claims map[string]interface{}
+		if err := idToken.Claims(&claims); err != nil {
+			return err
+		}
+		s.auth.IDToken, s.auth.Claims, idExpiry = rawIDToken, claims, idToken.Expiry
+	}
+
+	s.auth.AccessToken = token.AccessToken
+	if token.RefreshToken != "" {
+		s.refreshToken = token.RefreshToken
+	}
+	s.setExpiry(token.Expiry, idExpiry)
+
+	// Visas may have been renewed, or withdrawn, too
+	if visas, err := fetchPassport(idp, token, nil); err == nil {
+		s.auth.Visas = visas
+	} else {
+		log.Print("unable to refresh passport: ", err)
+	}
+	return nil
+}
+
+
+// Note when the first of the tokens expires
+func (s *session) setExpiry(accessExpiry time.Time, idExpiry time.Time) {
+	s.expiry = accessExpiry
+	if !idExpiry.IsZero() && (s.expiry.IsZero() || idExpiry.Before(s.expiry)) {
+		s.expiry = idExpiry
+	}
+}
@@ -0,0 +1,171 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package idp
+
+// Outstanding authentication requests, kept until the identity provider
+// calls back, and the random values that tie the callback to its request
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+
+// Structure for recording an outstanding auth request
+type authRequest struct {
+	idpi      int                               // Index of identity provider auth request went to
+	url       string                            // Original URL that was requested
+	nonce     string                            // Nonce the ID token must carry
+	verifier  string                            // PKCE code verifier
+	client    string                            // Address of the client that made the request
+	expires   time.Time                         // Time after which callback is refused
+}
+
+// Concurrency-safe store of outstanding requests, by state. States that
+// have been used, or have expired, are remembered for a while, so that a
+// replayed or late callback can be told from one that is merely unknown.
+type requestStore struct {
+	mutex    sync.Mutex
+	pending  map[string]authRequest
+	clients  map[string]int                     // Number of pending requests, by client
+	used     map[string]time.Time
+	expired  map[string]time.Time
+}
+
+
+// Time allowed for the user to sign in with the identity provider
+const requestTTL = 10 * time.Minute
+
+// Most requests that may be outstanding at once for a single client
+const maxPendingPerClient = 20
+
+// Errors for callbacks that cannot be matched to a request
+var (
+	ErrUnknownState  = errors.New("this sign-in attempt is not recognized")
+	ErrExpiredState  = errors.New("this sign-in attempt took too long and has expired")
+	ErrReplayedState = errors.New("this sign-in attempt has already been completed")
+	ErrTooManyLogins = errors.New("too many sign-in attempts are in progress from this address")
+)
+
+
+// Outstanding requests
+var requests = &requestStore{
+	pending: make(map[string]authRequest),
+	clients: make(map[string]int),
+	used: make(map[string]time.Time),
+	expired: make(map[string]time.Time),
+}
+
+
+// Record a request under a new, random state, which is returned. Each client
+// may have only so many requests outstanding at once.
+func (s *requestStore) put(req authRequest) (string, error) {
+	state, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.evict(time.Now())
+	if s.clients[req.client] >= maxPendingPerClient {
+		return "", ErrTooManyLogins
+	}
+
+	req.expires = time.Now().Add(requestTTL)
+	s.pending[state] = req
+	s.clients[req.client]++
+	return state, nil
+}
+
+
+// Remove and return the request recorded under a state. Each state may be
+// used only once, and only before it expires.
+func (s *requestStore) take(state string) (authRequest, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	s.evict(now)
+
+	req, ok := s.pending[state]
+	if !ok {
+		if _, replayed := s.used[state]; replayed {
+			return authRequest{}, ErrReplayedState
+		}
+		if _, late := s.expired[state]; late {
+			return authRequest{}, ErrExpiredState
+		}
+		return authRequest{}, ErrUnknownState
+	}
+
+	s.remove(state, req)
+	s.used[state] = req.expires
+	return req, nil
+}
+
+
+// Drop requests as they expire, remembering only their states. Used and
+// expired states are forgotten some time later; until then, a late callback
+// can be told that its request has expired.
+func (s *requestStore) evict(now time.Time) {
+	for state, req := range s.pending {
+		if now.After(req.expires) {
+			s.remove(state, req)
+			s.expired[state] = req.expires
+		}
+	}
+	for _, states := range []map[string]time.Time{s.used, s.expired} {
+		for state, expires := range states {
+			if now.After(expires.Add(requestTTL)) {
+				delete(states, state)
+			}
+		}
+	}
+}
+
+
+// Remove a pending request, and its client's count of them
+func (s *requestStore) remove(state string, req authRequest) {
+	delete(s.pending, state)
+	if s.clients[req.client]--; s.clients[req.client] <= 0 {
+		delete(s.clients, req.client)
+	}
+}
+
+
+// Generate a random string, URL-safe, from n bytes of cryptographic randomness
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+
+// PKCE code challenge for a verifier, by the S256 method (RFC 7636)
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -17,12 +17,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
 	"net/http"	
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -34,6 +40,12 @@ import (
 // A net/http handler function that also takes an authentication session argument
 type authenticatedHandler func (w http.ResponseWriter, r *http.Request, a *idp.Auth)
 
+// Largest request body accepted by /batch
+const maxBatchBytes = 10 << 20
+
+// Reason for refusing a batch whose body can't be read, or is too large
+var unreadableBody = fmt.Sprintf("unreadable request body, or larger than %d bytes", maxBatchBytes)
+
 // Upgrade structure for websocket connection
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
@@ -72,27 +84,44 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
 	// Process identity provider callback, checking tokens, etc.
 	auth, err := idp.Callback(w, r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		status := http.StatusInternalServerError
+		switch err {
+		case idp.ErrUnknownState, idp.ErrExpiredState, idp.ErrReplayedState:
+			status = http.StatusBadRequest
+		}
+		loginErrorPage(w, status, err)
+		return
 	}
 
-	// Store session authentication information in cookie
-	setCookie(w, r, auth, auth.ExpiresIn)
+	// Store session ID in cookie; the tokens stay on the server
+	setCookie(w, r, auth.SessionID, int(idp.SessionLifetime / time.Second))
 	
 	// Redirect to original page
 	http.Redirect(w, r, auth.URL, http.StatusFound)	
 }
 
 
+// Explain why signing in failed, and offer to try again
+func loginErrorPage(w http.ResponseWriter, status int, err error) {
+	t := template.Must(template.ParseFiles("static/template/error.html"))
+	w.WriteHeader(status)
+	t.Execute(w, struct{ Message string }{err.Error()})
+}
+
+
 // Authentication middleware. If not authenticated, redirect to login.
 func authenticated(f authenticatedHandler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var a idp.Auth
-		err := getCookie(r, &a)
-		if (err != nil) || (a.IDToken == "") {
+		var id string
+		if err := getCookie(r, &id); err != nil {
+			id = ""
+		}
+		a, err := idp.Session(id)
+		if err != nil {
 			url := "/login?page=" + url.QueryEscape(r.URL.String())
 			http.Redirect(w, r, url, http.StatusFound)
 		} else {
-			f(w, r, &a)
+			f(w, r, a)
 		}
 	}
 }
@@ -107,51 +136,241 @@ func queryPageHandler(w http.ResponseWriter, r *http.Request, a *idp.Auth) {
 		URL     string
 		Timeout int
 		Count   int
-	}{a.Name, url, timeout, beacon.Count()}
+		Visas   []idp.Visa
+	}{a.Name, url, timeout, beacon.Count(), a.Visas}
 	t.Execute(w, s)
 }
 
 
-// Handle beacon query; return results asynchronously via websocket
+// Handle beacon queries; return results asynchronously via websocket. A
+// message may hold a single query or a batch of them; responses are tagged
+// with the index of their query, and followed by a summary of all the
+// results. Each new message on the connection cancels any upstream requests
+// still outstanding for the previous one, as does the client disconnecting.
+// The session's tokens are refreshed as needed before each batch is sent; if
+// that fails, the client is told the session has expired.
 func queryAsyncHandler(w http.ResponseWriter, r *http.Request, a *idp.Auth) {
-	num := beacon.Count()
-	ch := make(chan beacon.BeaconResponse, num)
-
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
+	defer conn.Close()
+
+	// Read queries from the client until it disconnects
+	messages := make(chan []byte)
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		defer close(messages)
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			select {
+			case messages <- msg:
+			case <- quit:
+				return
+			}
+		}
+	}()
 
-	_, msg, err := conn.ReadMessage()
-	if err != nil {
-		return
+	var ch chan beacon.BeaconResponse          // Responses to the current queries
+	var summary *beacon.BatchSummary           // Results of the current queries
+	remaining := 0                             // Responses outstanding for current queries
+	cancel := context.CancelFunc(func() {})
+	defer func() { cancel() }()
+
+	for {
+		select {
+		case msg, ok := <-messages:
+			cancel()
+			if !ok {
+				return
+			}
+
+			queries, err := beacon.ParseQueries(msg)
+			if err != nil {
+				ch = nil
+				data, _ := json.Marshal(map[string]interface{}{"validationErrors": validationErrors(err)})
+				conn.WriteMessage(websocket.TextMessage, data)
+				continue
+			}
+
+			current, err := idp.Session(a.SessionID)
+			if err != nil {
+				ch = nil
+				data, _ := json.Marshal(map[string]interface{}{"sessionExpired": true, "message": err.Error()})
+				conn.WriteMessage(websocket.TextMessage, data)
+				continue
+			}
+
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(r.Context())
+			remaining = beacon.Count() * len(queries)
+			ch = make(chan beacon.BeaconResponse, remaining)
+			summary = beacon.NewBatchSummary(queries)
+			beacon.QueryBatch(ctx, queries, sessionPrincipal(current), timeout, ch)
+
+		// Forward responses over websocket as they arrive
+		case resp := <-ch:
+			summary.Add(resp)
+			conn.WriteMessage(websocket.TextMessage, responseJSON(resp))
+			if remaining--; remaining == 0 {
+				ch = nil
+				data, _ := json.Marshal(map[string]interface{}{"done": true, "summary": summary})
+				conn.WriteMessage(websocket.TextMessage, data)
+			}
+		}
 	}
+}
 
-	query := make(map[string][]string)
 
-	if err := json.Unmarshal(msg, &query); err != nil {
+// Answer a batch of queries, given as JSON (as for the websocket) or as an
+// uploaded VCF file, streaming each response as a line of JSON as it arrives,
+// followed by a summary of all the results. Batches fan out to every beacon,
+// so they are only answered for a signed-in user, or a caller whose bearer
+// token an identity provider accepts.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if !verifiedCaller(r) {
+		http.Error(w, "Batches require a session or a valid bearer token", http.StatusUnauthorized)
 		return
 	}
+	principal := requestPrincipal(r)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBytes)
+	queries, err := batchQueries(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"validationErrors": validationErrors(err)})
+		return
+	}
+
+	remaining := beacon.Count() * len(queries)
+	ch := make(chan beacon.BeaconResponse, remaining)
+	summary := beacon.NewBatchSummary(queries)
+	beacon.QueryBatch(r.Context(), queries, principal, timeout, ch)
 
-	beacon.QueryBeaconsAsync(query, a.AccessToken, a.IDToken, ch)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
 
-	// Collect responses, forwarding over websocket, or timeout
-	for i := 0; i < num; i++ {
+	for ; remaining > 0; remaining-- {
 		select {
-		case r := <-ch:
-			data, _ := json.Marshal(r)
-			conn.WriteMessage(websocket.TextMessage, data)
-		case <- time.After(time.Second * time.Duration(timeout)):
+		case resp := <-ch:
+			summary.Add(resp)
+			w.Write(append(responseJSON(resp), '\n'))
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
 			return
 		}
-	} 	
+	}
+
+	encoder.Encode(map[string]interface{}{"summary": summary})
+}
+
+
+// Serialize a beacon's response. One that can't be serialized is reported as
+// an error from that beacon, rather than sent empty.
+func responseJSON(resp beacon.BeaconResponse) []byte {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.Print("unable to encode response from beacon ", resp.Name, ": ", err)
+		data, _ = json.Marshal(map[string]interface{}{
+			"name": resp.Name,
+			"status": http.StatusInternalServerError,
+			"query": resp.Query,
+			"queryIndex": resp.QueryIndex,
+			"error": map[string]string{"code": "500", "message": "unable to encode the beacon's response"},
+		})
+	}
+	return data
+}
+
+
+// Whether a request comes from a signed-in user, or bears an access token
+// that one of the identity providers accepts
+func verifiedCaller(r *http.Request) bool {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return idp.VerifyAccessToken(r.Context(), strings.TrimPrefix(h, "Bearer ")) == nil
+	}
+
+	var id string
+	if err := getCookie(r, &id); err != nil {
+		return false
+	}
+	_, err := idp.Session(id)
+	return err == nil
+}
+
+
+// Read a batch from a request: JSON, a multipart form with a "vcf" file, or
+// VCF text. For VCF, the assemblyId and datasetIds come from the query string.
+func batchQueries(r *http.Request) ([]beacon.BeaconQuery, error) {
+	body := io.Reader(r.Body)
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch contentType {
+	case "application/json":
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, beacon.ValidationError{{Field: "body", Message: unreadableBody}}
+		}
+		return beacon.ParseQueries(data)
+
+	case "multipart/form-data":
+		file, _, err := r.FormFile("vcf")
+		if err == http.ErrMissingFile {
+			return nil, beacon.ValidationError{{Field: "vcf", Message: "no file uploaded"}}
+		} else if err != nil {
+			return nil, beacon.ValidationError{{Field: "body", Message: unreadableBody}}
+		}
+		defer file.Close()
+		body = file
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, beacon.ValidationError{{Field: "body", Message: unreadableBody}}
+	}
+
+	q := r.URL.Query()
+	defaults := beacon.BeaconQuery{AssemblyId: q.Get("assemblyId"), DatasetIds: q["datasetIds"]}
+	return beacon.ParseBatchVCF(string(data), defaults)
+}
+
+
+// The problems with a query or batch, as a list of fields and messages.
+// Other errors are reported against the body as a whole.
+func validationErrors(err error) beacon.ValidationError {
+	if errs, ok := err.(beacon.ValidationError); ok {
+		return errs
+	}
+	return beacon.ValidationError{{Field: "body", Message: err.Error()}}
+}
+
+
+// Report the health of each beacon, for operators
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	data, _ := json.Marshal(beacon.Health())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+
+// Describe the configured beacons and their datasets
+func beaconsHandler(w http.ResponseWriter, r *http.Request) {
+	data, _ := json.Marshal(beacon.Beacons())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
 }
 
 
 // Handle logout request
 func logoutHandler(w http.ResponseWriter, r *http.Request, a *idp.Auth) {
-	idp.Logout(a.ProviderIdx, a.AccessToken)
-	setCookie(w, r, a, logout)
+	idp.Logout(a.SessionID)
+	setCookie(w, r, "", logout)
 	
 	// Redirect to login
 	http.Redirect(w, r, "/login?page=/", http.StatusFound)
@@ -160,6 +379,8 @@ func logoutHandler(w http.ResponseWriter, r *http.Request, a *idp.Auth) {
 
 // Entry point
 func main() {
+	configure()
+
 	fmt.Printf("BoB is listening on %s:%d\n", host, port)
 
 	fs := http.FileServer(http.Dir("static/"))
@@ -172,6 +393,11 @@ func main() {
 	r.HandleFunc("/", authenticated(queryPageHandler))	
 	r.HandleFunc("/ws", authenticated(queryAsyncHandler))
 	r.HandleFunc("/logout", authenticated(logoutHandler))
+	r.HandleFunc("/health", healthHandler).Methods("GET")
+	r.HandleFunc("/beacons", beaconsHandler).Methods("GET")
+	r.HandleFunc("/info", beaconInfoHandler).Methods("GET")
+	r.HandleFunc("/query", beaconQueryHandler).Methods("GET", "POST")
+	r.HandleFunc("/batch", batchHandler).Methods("POST")
 
 	http.ListenAndServe(fmt.Sprintf(":%d", port), r)
 }
@@ -0,0 +1,83 @@
+/***************************************************************************
+ Copyright 2017 William Knox Carey
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ ***************************************************************************/
+
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/knoxcarey/bob/beacon"
+)
+
+
+// A refused batch says why, whatever the kind of error
+func TestBatchErrors(t *testing.T) {
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	writer.WriteField("assemblyId", "GRCh37")
+	writer.Close()
+
+	tests := []struct {
+		name         string
+		contentType  string
+		body         string
+		want         string                     // Expected in the message
+	}{
+		{"no file", writer.FormDataContentType(), form.String(), "no file uploaded"},
+		{"too large", "text/plain", strings.Repeat("x", maxBatchBytes + 1), "larger than"},
+		{"malformed JSON", "application/json", "{", "malformed"},
+		{"no data lines", "text/plain", "#CHROM\tPOS\tID\tREF\tALT\n", "no data lines"},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/batch", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", test.contentType)
+		r.Body = http.MaxBytesReader(w, r.Body, maxBatchBytes)
+
+		_, err := batchQueries(r)
+		if err == nil {
+			t.Errorf("%s: accepted, want error", test.name)
+			continue
+		}
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"validationErrors": validationErrors(err)})
+
+		var reply struct {
+			ValidationErrors []beacon.FieldError `json:"validationErrors"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || len(reply.ValidationErrors) == 0 {
+			t.Errorf("%s: body %s, want validation errors", test.name, w.Body.String())
+			continue
+		}
+		if !strings.Contains(reply.ValidationErrors[0].Message, test.want) {
+			t.Errorf("%s: message %q, want %q", test.name, reply.ValidationErrors[0].Message, test.want)
+		}
+	}
+
+	// Errors of other kinds are reported against the body
+	errs := validationErrors(errors.New("unexpected"))
+	if len(errs) != 1 || errs[0].Field != "body" || errs[0].Message != "unexpected" {
+		t.Errorf("plain error: got %v", errs)
+	}
+}
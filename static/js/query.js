@@ -1,23 +1,24 @@
 var socket;
 var url;
 var inElement;
+var assemblyElement;
 var outElement;
 var button;
 var timer;
 var timeout;
 var count;
-var counter;
 var loader;
 
 
 // Connect to various elements on the page
-function connect(u, i, o, b, l, t, n) {
+function connect(u, i, a, o, b, l, t, n) {
     inElement = document.getElementById(i);
     inElement.onkeypress = (e) => {
 	if (e.charCode == 13) {
 	    bobQuery(inElement);
 	}
     };
+    assemblyElement = document.getElementById(a);
     outElement = document.getElementById(o);
     url = u;
     
@@ -34,32 +35,34 @@ function connect(u, i, o, b, l, t, n) {
 
 // Insert test data into the page (for development)
 function addTestData() {
-    displayResult('{"name":"ICGC","status":200,"responses":{"ICGC":"true"}}');
-    displayResult('{"name":"Cosmic","status":200,"icon":"sanger.png","responses":{"Cosmic":"true"}}');
+    displayResult('{"name":"ICGC","status":200,"schemaVersion":2,"results":{"ICGC":{"exists":true}}}');
+    displayResult('{"name":"Cosmic","status":200,"schemaVersion":2,"icon":"sanger.png","results":{"Cosmic":{"exists":true,"sampleCount":3}}}');
 }
 
 
 // Query the beacon of beacons asynchronously
 function bobQuery(queryElement) {
-    var qs = {};
-    var qa = queryElement.value.split(/[^0-9a-zA-Z]/);
+    var text = queryElement.value.trim();
 
-    if (qa[0]) qs.chromosome     = [qa[0]];
-    if (qa[1]) qs.start          = [qa[1]];
-    if (qa[2]) qs.referenceBases = [qa[2]];
-    if (qa[3]) qs.alternateBases = [qa[3]];
-    qs.assemblyId = ["GRCh37"];    // FIXME: assembly should not be hardcoded
+    // The server recognizes the notation: HGVS, VCF, SPDI or chromosome:position.
+    // Several variants, separated by semicolons, are sent as a batch.
+    var variants = text.split(';').map((v) => v.trim()).filter((v) => v);
+    var qs = variants.length > 1 ? {queries: variants.map((v) => ({variant: v}))} : {variant: text};
+
+    // Accessions imply their own assembly; beacons serving another are lifted over
+    if (!/(^|;)\s*(NC_|CM0)/i.test(text)) qs.assemblyId = assemblyElement.value;
 
     if (outElement.innerHTML) {outElement.innerHTML = null;}    
-    if (socket) {socket.close();}
-    socket = new WebSocket(url);    
-    socket.onmessage = (e) => {
-	counter = counter - 1;
-	if(counter == 0) {cancelQuery();}
-	displayResult(e.data)
-    };
-    socket.onopen = () => {socket.send(JSON.stringify(qs))};
-    counter = count;
+
+    // Reuse an open connection; the server cancels the previous query
+    if (socket && socket.readyState == WebSocket.OPEN) {
+	socket.send(JSON.stringify(qs));
+    } else {
+	if (socket) {socket.close();}
+	socket = new WebSocket(url);    
+	socket.onmessage = (e) => {displayResult(e.data)};
+	socket.onopen = () => {socket.send(JSON.stringify(qs))};
+    }
     clearTimeout(timer);
     timer = setTimeout(cancelQuery, timeout);
     loader.style['visibility'] = 'visible';
@@ -70,18 +73,169 @@ function bobQuery(queryElement) {
 // Display a beacon result
 function displayResult(r) {
     var json = JSON.parse(r);
+
+    if (json.done) {
+	if (json.summary && json.summary.queries.length > 1) {
+	    displaySummary(json.summary);
+	}
+	cancelQuery();
+	return;
+    }
+
+    if (json.validationErrors) {
+	displayErrors(json.validationErrors);
+	return;
+    }
+
+    if (json.sessionExpired) {
+	displaySessionExpired(json.message);
+	return;
+    }
+
     var result = document.createElement('div');
     result.className += 'beacon clearfix';
-    result.innerHTML = '<div class="image"><img class="icon" src="/static/img/' + (json.icon || "__default.png") + '"/></div>';
-    result.innerHTML += '<div class="beaconname">' + json.name + '</div>';
+    result.innerHTML = '<div class="image"><img class="icon" src="' + escapeHTML(iconURL(json.icon)) + '"/></div>';
+    result.innerHTML += '<div class="beaconname">' + escapeHTML(json.name) + '</div>';
+    result.innerHTML += '<div class="assembly">' + escapeHTML(json.assemblyId || '') + '</div>';
+
+    // Distinguish the alleles of a multi-allelic query
+    if (json.query && (json.query.alternateBases || json.query.variantType)) {
+	result.innerHTML += '<div class="allele">' + escapeHTML(json.query.alternateBases || json.query.variantType) + '</div>';
+    }
 
-    for (var dataset in json.responses) {
-	if (json.responses.hasOwnProperty(dataset)) {
-	    result.innerHTML += '<div class="response">' + json.responses[dataset] + '</div>';
+    for (var dataset in json.results) {
+	if (json.results.hasOwnProperty(dataset)) {
+	    var info = json.datasetInfo && json.datasetInfo[dataset];
+	    result.innerHTML += '<div class="response" title="' + datasetTitle(dataset, info) + '">' + resultText(json.results[dataset]) + '</div>';
 	}
     }
 
+    if (json.error && json.error.message) {
+	result.innerHTML += '<div class="response">' + escapeHTML(json.error.message) + '</div>';
+    }
+
+    if (json.health == 'open') {
+	result.className += ' unavailable';
+    }
+
+    if (json.missing) {
+	result.className += ' unauthorized';
+    }
+
+    if (json.notQueried) {
+	result.innerHTML += '<div class="response">not queried: ' + escapeHTML(json.notQueried) + '</div>';
+	result.className += ' notqueried';
+    }
+
+    outElement.appendChild(result);
+}
+
+
+// Display the results of a batch as a table of variants by beacons
+function displaySummary(summary) {
+    var table = '<table class="summary"><tr><th></th>';
+    for (var j = 0; j < summary.beacons.length; j++) {
+	table += '<th>' + escapeHTML(summary.beacons[j]) + '</th>';
+    }
+    table += '</tr>';
+
+    for (var i = 0; i < summary.queries.length; i++) {
+	table += '<tr><th>' + escapeHTML(queryLabel(summary.queries[i])) + '</th>';
+	for (var j = 0; j < summary.beacons.length; j++) {
+	    var result = summary.results[i][j];
+	    table += '<td class="' + result + '">' + result + '</td>';
+	}
+	table += '</tr>';
+    }
+    table += '</table>';
+
+    var result = document.createElement('div');
+    result.className += 'beacon clearfix';
+    result.innerHTML = table;
+    outElement.insertBefore(result, outElement.firstChild);
+}
+
+
+// Icons are files in /static/img/, or a beacon's own logo
+function iconURL(icon) {
+    if (!icon) return '/static/img/__default.png';
+    return /^https?:\/\//.test(icon) ? icon : '/static/img/' + icon;
+}
+
+
+// Describe a dataset's result: whether it has the variant, how often, and
+// links to more about it; only http(s) links are shown
+function resultText(r) {
+    var text = r.error ? escapeHTML(r.error) : r.exists === true ? 'true' : r.exists === false ? 'false' : 'unknown';
+
+    var counts = [];
+    if (r.frequency !== undefined) counts.push('frequency ' + r.frequency);
+    if (r.sampleCount !== undefined) counts.push(r.sampleCount + ' samples');
+    if (r.variantCount !== undefined) counts.push(r.variantCount + ' variants');
+    if (counts.length > 0) text += ' (' + counts.join(', ') + ')';
+
+    var links = (r.handovers || []).slice();
+    if (r.externalUrl) links.push({type: 'dataset', url: r.externalUrl});
+    for (var i = 0; i < links.length; i++) {
+	if (!/^https?:\/\//i.test(links[i].url)) continue;
+	text += ' <a href="' + escapeHTML(links[i].url) + '" target="_blank">' + escapeHTML(links[i].type || 'more') + '</a>';
+    }
+    return text;
+}
+
+
+// Describe a dataset, as far as its beacon does, for display on hover
+function datasetTitle(id, info) {
+    var parts = [id];
+    if (info) {
+	if (info.description) parts.push(info.description);
+	if (info.assemblyId) parts.push('Assembly: ' + info.assemblyId);
+	if (info.sampleCount) parts.push('Samples: ' + info.sampleCount);
+	if (info.variantCount) parts.push('Variants: ' + info.variantCount);
+	if (info.version) parts.push('Version: ' + info.version);
+	if (info.externalUrl) parts.push(info.externalUrl);
+    }
+    return escapeHTML(parts.join('\n'));
+}
+
+
+// Escape text for use in HTML, whether as content or in an attribute
+function escapeHTML(text) {
+    return String(text).replace(/&/g, '&amp;').replace(/"/g, '&quot;').replace(/</g, '&lt;').replace(/>/g, '&gt;');
+}
+
+
+// Short description of a query in the shorthand notation, whose positions
+// count from one, e.g. 13:32900706 A>T
+function queryLabel(q) {
+    var position = q.start !== undefined ? q.start + 1 : (q.startMin + 1) + '..' + (q.startMax + 1);
+    if (q.end !== undefined) position += '-' + q.end;
+    var change = q.alternateBases ? (q.referenceBases || '') + '>' + q.alternateBases : (q.variantType || '');
+    return q.referenceName + ':' + position + ' ' + change;
+}
+
+
+// Display problems with the query
+function displayErrors(errors) {
+    var result = document.createElement('div');
+    result.className += 'beacon clearfix';
+
+    for (var i = 0; i < errors.length; i++) {
+	result.innerHTML += '<div class="error">' + escapeHTML(errors[i].field + ': ' + errors[i].message) + '</div>';
+    }
+
+    outElement.appendChild(result);
+    cancelQuery();
+}
+
+
+// Tell the user that their session has expired, and offer to sign in again
+function displaySessionExpired(message) {
+    var result = document.createElement('div');
+    result.className += 'beacon clearfix';
+    result.innerHTML = '<div class="error">' + escapeHTML(message) + ' <a href="/login?page=/">Sign in</a></div>';
     outElement.appendChild(result);
+    cancelQuery();
 }
 
 